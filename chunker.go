@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"log"
+)
+
+// big files get split into chunks at places determined by their contents (a rolling hash of the last few dozen bytes)
+// so, inserting or appending a little bit only changes the chunks right around there, and every other chunk stays exactly the same and doesn't need to be uploaded again
+const (
+	chunkMinSize = 1024 * 1024
+	chunkMaxSize = 16 * 1024 * 1024
+	chunkBits    = 22 // average chunk size is about 2^22 = 4mb past the minimum
+)
+
+// only look at the top bits, the bottom bits of a gear hash only depend on the last couple bytes
+const chunkMask = ((1 << chunkBits) - 1) << (64 - chunkBits)
+
+// must never change, or every chunk boundary of every file will move
+var gearTable = makeGearTable()
+
+type Chunker struct {
+	in    io.Reader
+	buf   []byte
+	start int // buf[start:end] is what's been read but not chunked yet
+	end   int
+	eof   bool
+}
+
+// one chunk of a file, in order
+type fileChunk struct {
+	hash   []byte
+	size   int64
+	offset int64 // within the file
+}
+
+// a file that was split up into chunks
+type chunkedFile struct {
+	hash   []byte
+	chunks []fileChunk
+}
+
+func makeGearTable() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		h := sha256.Sum256([]byte{'g', 'b', byte(i)})
+		table[i] = binary.BigEndian.Uint64(h[:8])
+	}
+	return table
+}
+
+func NewChunker(in io.Reader) *Chunker {
+	return &Chunker{in: in, buf: make([]byte, chunkMaxSize)}
+}
+
+// returns the next chunk, or nil at the end of the file
+// the returned slice is only valid until the next call
+func (c *Chunker) Next() []byte {
+	// keep the buffer full so that a whole chunk is always available
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	if !c.eof && c.end < len(c.buf) {
+		n, err := io.ReadFull(c.in, c.buf[c.end:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			panic(err)
+		}
+		c.end += n
+	}
+	if c.end == 0 {
+		return nil
+	}
+	c.start = chunkBoundary(c.buf[:c.end])
+	return c.buf[:c.start]
+}
+
+func chunkBoundary(data []byte) int {
+	if len(data) <= chunkMinSize {
+		return len(data)
+	}
+	var hash uint64
+	for i := chunkMinSize; i < len(data); i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data) // either max size or end of file
+}
+
+// split this file into chunks and write the ones we don't already have into the blob
+// seen is chunks that have already been written into this blob, so they don't get written twice
+func writeChunks(path string, in io.Reader, out io.Writer, position *HasherSizer, seen map[[32]byte]bool, btx *blobTx) ([]BlobEntry, []fileChunk) {
+	entries := make([]BlobEntry, 0)
+	chunks := make([]fileChunk, 0)
+	chunker := NewChunker(in)
+	offset := int64(0)
+	for {
+		data := chunker.Next()
+		if data == nil {
+			break
+		}
+		hashArr := sha256.Sum256(data)
+		hash := hashArr[:]
+		chunks = append(chunks, fileChunk{hash, int64(len(data)), offset})
+		offset += int64(len(data))
+		if seen[hashArr] || btx.entryExists(hash) {
+			log.Println("Already have chunk", hex.EncodeToString(hash), "of", path)
+			continue
+		}
+		seen[hashArr] = true
+		entry := writeEntry(path, bytes.NewReader(data), out, position)
+		entry.hash = hash
+		entries = append(entries, entry)
+	}
+	log.Println(path, "was split into", len(chunks), "chunks, of which", len(entries), "were new")
+	return entries, chunks
+}
+
+func entryExists(hash []byte, tx *sql.Tx) bool {
+	var exists bool
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM blob_entries WHERE hash = ?)", hash).Scan(&exists)
+	if err != nil {
+		panic(err)
+	}
+	return exists
+}
+
+func saveChunkHashes(file chunkedFile, tx *sql.Tx) {
+	for _, chunk := range file.chunks {
+		_, err := tx.Exec("INSERT OR IGNORE INTO hashes (hash, size) VALUES (?, ?)", chunk.hash, chunk.size)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func saveChunkList(file chunkedFile, tx *sql.Tx) {
+	var exists bool
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM file_chunks WHERE hash = ?)", file.hash).Scan(&exists)
+	if err != nil {
+		panic(err)
+	}
+	if exists {
+		log.Println("Already have a chunk list for", hex.EncodeToString(file.hash))
+		return
+	}
+	for i, chunk := range file.chunks {
+		_, err := tx.Exec("INSERT INTO file_chunks (hash, idx, chunk_hash, offset) VALUES (?, ?, ?, ?)", file.hash, i, chunk.hash, chunk.offset)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func chunkList(hash []byte, tx *sql.Tx) [][]byte {
+	rows, err := tx.Query("SELECT chunk_hash FROM file_chunks WHERE hash = ? ORDER BY idx", hash)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	chunks := make([][]byte, 0)
+	for rows.Next() {
+		var chunkHash []byte
+		err := rows.Scan(&chunkHash)
+		if err != nil {
+			panic(err)
+		}
+		chunks = append(chunks, chunkHash)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return chunks
+}
+
+// reads chunks one at a time, only fetching the next when the previous one is used up
+type chunksReader struct {
+	chunks  [][]byte
+	current io.Reader
+	tx      *sql.Tx
+}
+
+func (r *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			r.current = cat(r.chunks[0], r.tx)
+			r.chunks = r.chunks[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leijurv/gb/config"
+)
+
+func chunkHashes(data []byte) [][32]byte {
+	chunker := NewChunker(bytes.NewReader(data))
+	hashes := make([][32]byte, 0)
+	total := 0
+	for {
+		chunk := chunker.Next()
+		if chunk == nil {
+			break
+		}
+		if len(chunk) > chunkMaxSize {
+			panic("chunk too big")
+		}
+		total += len(chunk)
+		hashes = append(hashes, sha256.Sum256(chunk))
+	}
+	if total != len(data) {
+		panic("chunks don't add up to the whole file")
+	}
+	return hashes
+}
+
+func TestChunkBoundariesResync(t *testing.T) {
+	data := randBytes(50000000)
+	before := chunkHashes(data)
+	after := chunkHashes(append([]byte("owo"), data...))
+	if len(before) < 3 {
+		t.Fatalf("only got %d chunks", len(before))
+	}
+	old := make(map[[32]byte]bool)
+	for _, hash := range before {
+		old[hash] = true
+	}
+	changed := 0
+	for _, hash := range after {
+		if !old[hash] {
+			changed++
+		}
+	}
+	if changed != 1 {
+		t.Errorf("inserting at the start changed %d of %d chunks, expected only the first one to change", changed, len(after))
+	}
+}
+
+func withChunkingMinSize(size int64, fn func()) {
+	old := config.Config()
+	defer config.SetConfig(old)
+	c := old
+	c.ChunkingMinSize = size
+	config.SetConfig(c)
+	fn()
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		withChunkingMinSize(1, func() {
+			path := filepath.Join(src, "a")
+			data := randBytes(2*chunkMaxSize + 1) // so there have to be at least 3 chunks
+			err := ioutil.WriteFile(path, data, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			upload(backupADirectoryRecursively(src))
+			chunks := countRows(t, "SELECT COUNT(*) FROM file_chunks")
+			if chunks < 2 {
+				t.Fatalf("expected the file to be split into chunks, got %d", chunks)
+			}
+			whole := sha256.Sum256(data)
+			if n := countRows(t, "SELECT COUNT(*) FROM blob_entries WHERE hash = ?", whole[:]); n != 0 {
+				t.Fatalf("the whole file shouldn't have its own entry")
+			}
+			if n := countRows(t, "SELECT COUNT(*) FROM blob_entries"); n != chunks {
+				t.Fatalf("expected an entry per chunk, got %d entries for %d chunks", n, chunks)
+			}
+			testAll() // panics on mismatch, this is what rebuilds the file from its chunks
+
+			// insert a little at the start, only the chunk or two around there should be new
+			nextBackup()
+			err = ioutil.WriteFile(path, append([]byte("hello"), data...), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			later := time.Now().Add(time.Hour)
+			err = os.Chtimes(path, later, later)
+			if err != nil {
+				t.Fatal(err)
+			}
+			upload(backupADirectoryRecursively(src))
+			if n := countRows(t, "SELECT COUNT(*) FROM blob_entries"); n <= chunks || n > chunks+2 {
+				t.Errorf("expected one or two new chunks, got %d entries after %d", n, chunks)
+			}
+			testAll()
+
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Commit()
+			restored, err := ioutil.ReadAll(cat(whole[:], tx))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(restored, data) {
+				t.Errorf("the old version didn't come back the same")
+			}
+		})
+	})
+}
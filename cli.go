@@ -1 +1,290 @@
 package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type command struct {
+	usage string
+	run   func(args []string)
+}
+
+var commands map[string]command
+
+func init() {
+	// in init because help refers back to commands, which go considers an initialization loop
+	commands = map[string]command{
+		"backup":    {"backup [path...]   scan the given folders (default .) then upload anything new", cmdBackup},
+		"replicate": {"replicate <label>  copy every blob that isn't on that storage yet onto it", cmdReplicate},
+		"test":      {"test               download every file we have and check its hash", cmdTest},
+		"storage":   {"storage add|list|label|remove   manage where blobs get uploaded to", cmdStorage},
+		"restore":   {"restore <path> [-at time] -to <dir>   restore a file or folder as it was at some time (default now)", cmdRestore},
+		"history":   {"history <path> [-version n [-cat | -to file]]   list every version of a file, or get one of them back", cmdHistory},
+		"ls":        {"ls <path> [-at time] [-r]   show what was backed up in a folder at some time (default now)", cmdLs},
+		"gc":        {"gc [-n]   delete blobs that no file refers to anymore (-n to only show what would be deleted)", cmdGc},
+		"expire":    {"expire [-n]   forget old versions of files according to the retention config (-n to only show what would be forgotten)", cmdExpire},
+		"repack":    {"repack [-threshold f] [-n]   rewrite the live parts of mostly dead blobs into new blobs, then delete the old ones", cmdRepack},
+		"orphans":   {"orphans [label] [-delete]   list objects on a storage (default every storage) that the database doesn't know about, and optionally delete them", cmdOrphans},
+		"fsck":      {"fsck               check that the database is consistent, exits non-zero if it isn't", cmdFsck},
+		"help":      {"help               this", cmdHelp},
+	}
+}
+
+func runCLI(args []string) {
+	if len(args) == 0 {
+		cmdHelp(nil)
+		os.Exit(1)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Unknown command", args[0])
+		cmdHelp(nil)
+		os.Exit(1)
+	}
+	cmd.run(args[1:])
+}
+
+func cmdHelp(args []string) {
+	names := make([]string, 0)
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Usage: gb <command> [arguments]")
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  gb "+commands[name].usage)
+	}
+}
+
+// prints the problem and exits, for when the user asked for something that doesn't make sense
+func usageError(msg ...interface{}) {
+	fmt.Fprintln(os.Stderr, msg...)
+	os.Exit(1)
+}
+
+func cmdBackup(args []string) {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	hashLater := make([]ToUpload, 0)
+	for _, path := range args {
+		hashLater = append(hashLater, backupADirectoryRecursively(path)...)
+	}
+	upload(hashLater)
+	if len(scanErrors) > 0 {
+		// everything else got backed up, but this should still get noticed if it's running from cron
+		fmt.Fprintln(os.Stderr, len(scanErrors), "paths couldn't be read, so they were left as they were last time:")
+		for _, scanErr := range scanErrors {
+			fmt.Fprintln(os.Stderr, "  "+scanErr.path+":", scanErr.err)
+		}
+		os.Exit(1)
+	}
+}
+
+func cmdTest(args []string) {
+	testAll()
+}
+
+func cmdFsck(args []string) {
+	if fsck() > 0 {
+		os.Exit(1)
+	}
+}
+
+func cmdExpire(args []string) {
+	flags := flag.NewFlagSet("expire", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "dry run, only show what would be forgotten")
+	flags.Parse(args)
+	expire(*dryRun)
+}
+
+func cmdGc(args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "dry run, only show what would be deleted")
+	flags.Parse(args)
+	gc(*dryRun)
+}
+
+func cmdRepack(args []string) {
+	flags := flag.NewFlagSet("repack", flag.ExitOnError)
+	threshold := flags.Float64("threshold", 0.5, "repack blobs where less than this fraction of the bytes are still needed")
+	dryRun := flags.Bool("n", false, "dry run, only show what would be repacked")
+	flags.Parse(args)
+	if *threshold <= 0 || *threshold > 1 {
+		usageError("Threshold should be more than 0 and at most 1")
+	}
+	repack(*threshold, *dryRun)
+}
+
+func cmdHistory(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	version := flags.Int("version", 0, "which version, as numbered in the list")
+	catIt := flags.Bool("cat", false, "write that version to stdout")
+	to := flags.String("to", "", "restore that version to this path")
+	paths := parseFlags(flags, args)
+	if len(paths) != 1 || (*version != 0) != (*catIt || *to != "") {
+		usageError("Usage: gb history <path> [-version n [-cat | -to file]]")
+	}
+	showHistory(paths[0], *version, *catIt, *to)
+}
+
+func cmdLs(args []string) {
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	at := flags.String("at", "now", "when to look at: unix seconds, or something like 2006-01-02 or \"2006-01-02 15:04\" in local time")
+	recursive := flags.Bool("r", false, "list everything inside subfolders too, instead of one line per subfolder")
+	paths := parseFlags(flags, args)
+	if len(paths) > 1 {
+		usageError("Usage: gb ls <path> [-at time] [-r]")
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	ls(paths[0], parseTimestamp(*at), *recursive)
+}
+
+func cmdOrphans(args []string) {
+	flags := flag.NewFlagSet("orphans", flag.ExitOnError)
+	del := flags.Bool("delete", false, "delete them, after asking")
+	labels := parseFlags(flags, args)
+	if len(labels) > 1 {
+		usageError("Usage: gb orphans [label] [-delete]")
+	}
+	label := ""
+	if len(labels) == 1 {
+		label = labels[0]
+	}
+	orphans := findOrphans(label)
+	total := showOrphans(orphans)
+	if !*del || len(orphans) == 0 {
+		return
+	}
+	if !confirm(fmt.Sprint("Delete these ", len(orphans), " objects (", total, " bytes)? Make sure no backup is uploading right now")) {
+		fmt.Println("Not deleting anything")
+		return
+	}
+	deleteOrphans(orphans)
+}
+
+func cmdReplicate(args []string) {
+	if len(args) != 1 {
+		usageError("Usage: gb replicate <label>")
+	}
+	replicate(args[0])
+}
+
+func cmdRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	at := flags.String("at", "now", "when to restore from: unix seconds, or something like 2006-01-02 or \"2006-01-02 15:04\" in local time")
+	to := flags.String("to", "", "folder to restore into")
+	paths := parseFlags(flags, args)
+	if len(paths) != 1 || *to == "" {
+		usageError("Usage: gb restore <path> [-at time] -to <dir>")
+	}
+	if restore(paths[0], parseTimestamp(*at), *to) > 0 {
+		os.Exit(1)
+	}
+}
+
+func cmdStorage(args []string) {
+	if len(args) == 0 {
+		usageError("Usage: gb storage add|list|label|remove")
+	}
+	switch args[0] {
+	case "add":
+		flags := flag.NewFlagSet("storage add", flag.ExitOnError)
+		label := flags.String("label", "", "a name for this storage, e.g. \"my s3\"")
+		kind := flags.String("type", "", "S3 or Disk")
+		identifier := flags.String("identifier", "", "bucket name for S3, drive UUID (or mountpoint) for Disk")
+		rootPath := flags.String("root", "gb/", "folder within that to store blobs in")
+		endpoint := flags.String("endpoint", "", "S3 only: endpoint url, for S3-compatible providers such as minio, b2 or wasabi")
+		region := flags.String("region", defaultS3Region, "S3 only: region")
+		pathStyle := flags.Bool("path-style", false, "S3 only: use path style addressing (bucket in the path, not the hostname)")
+		profile := flags.String("profile", "", "S3 only: profile in ~/.aws/credentials to use, instead of the default credential chain")
+		flags.Parse(args[1:])
+		if *label == "" || *kind == "" || *identifier == "" {
+			flags.Usage()
+			os.Exit(1)
+		}
+		var s3Options *S3Options
+		if *kind == "S3" {
+			s3Options = &S3Options{
+				endpoint:  nilIfEmpty(*endpoint),
+				region:    *region,
+				pathStyle: *pathStyle,
+				profile:   nilIfEmpty(*profile),
+			}
+		}
+		addStorage(*label, *kind, *identifier, *rootPath, s3Options)
+	case "list":
+		listStorages()
+	case "label":
+		if len(args) != 3 {
+			usageError("Usage: gb storage label <old label> <new label>")
+		}
+		labelStorage(args[1], args[2])
+	case "remove":
+		if len(args) != 2 {
+			usageError("Usage: gb storage remove <label>")
+		}
+		removeStorage(args[1])
+	default:
+		usageError("Unknown storage command " + strings.Join(args, " "))
+	}
+}
+
+// asks on stderr and reads the answer from stdin, anything but y or yes is a no
+func confirm(question string) bool {
+	fmt.Fprint(os.Stderr, question+" [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// flag stops at the first non-flag argument, but `gb restore path -to dir` should work as well as `gb restore -to dir path`
+// returns the non-flag arguments
+func parseFlags(flags *flag.FlagSet, args []string) []string {
+	positional := make([]string, 0)
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// unix seconds, since that's what files.start and files.end are
+func parseTimestamp(str string) int64 {
+	if str == "now" {
+		return time.Now().Unix()
+	}
+	if unix, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return unix
+	}
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t.Unix()
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, str, time.Local); err == nil {
+			return t.Unix()
+		}
+	}
+	usageError("Don't know what time", str, "is supposed to be")
+	return 0
+}
+
+func nilIfEmpty(str string) *string {
+	if str == "" {
+		return nil
+	}
+	return &str
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/DataDog/zstd"
+	"github.com/leijurv/gb/config"
+)
+
+type Compression interface {
+	Compress(out io.Writer) io.WriteCloser
+	Decompress(in io.Reader) io.ReadCloser
+	AlgName() string // what goes in blob_entries.compression_alg
+}
+
+type ZstdCompression struct{}
+
+type GzipCompression struct{}
+
+var compressionAlgs = []Compression{&ZstdCompression{}, &GzipCompression{}}
+
+// how much of the start of a file to try compressing to see if it's worth it
+const compressionSampleSize = 1024 * 1024
+
+// if the sample doesn't get at least this much smaller, don't bother
+const compressionMinRatio = 0.9
+
+// these are already compressed, so compressing them again is a waste of time
+var incompressibleExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true,
+	".mp4": true, ".mov": true, ".mkv": true, ".avi": true, ".webm": true, ".m4v": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".flac": true, ".ogg": true, ".opus": true,
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+	".jar": true, ".apk": true, ".dmg": true, ".docx": true, ".xlsx": true, ".pptx": true,
+}
+
+func CompressionByName(name string) Compression {
+	for _, alg := range compressionAlgs {
+		if alg.AlgName() == name {
+			return alg
+		}
+	}
+	panic("Unknown compression algorithm " + name)
+}
+
+// decide how to compress this file, if at all
+// this reads the start of the file to try it out, so use the returned reader instead of the one passed in (it has the sample put back at the start)
+func chooseCompression(path string, in io.Reader) (Compression, io.Reader) {
+	name := config.Config().Compression
+	if name == "" || name == "none" {
+		return nil, in
+	}
+	if incompressibleExtensions[strings.ToLower(filepath.Ext(path))] {
+		return nil, in
+	}
+	sample := make([]byte, compressionSampleSize)
+	n, err := io.ReadFull(in, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		panic(err)
+	}
+	sample = sample[:n]
+	in = io.MultiReader(bytes.NewReader(sample), in)
+	if n == 0 {
+		return nil, in
+	}
+	alg := CompressionByName(name)
+	var buf bytes.Buffer
+	c := alg.Compress(&buf)
+	if _, err := c.Write(sample); err != nil {
+		panic(err)
+	}
+	if err := c.Close(); err != nil {
+		panic(err)
+	}
+	if float64(buf.Len()) > float64(n)*compressionMinRatio {
+		return nil, in
+	}
+	return alg, in
+}
+
+func (n *ZstdCompression) Compress(out io.Writer) io.WriteCloser {
+	return zstd.NewWriter(out)
+}
+
+func (n *ZstdCompression) Decompress(in io.Reader) io.ReadCloser {
+	return zstd.NewReader(in)
+}
+
+func (n *ZstdCompression) AlgName() string {
+	return "zstd"
+}
+
+func (n *GzipCompression) Compress(out io.Writer) io.WriteCloser {
+	return gzip.NewWriter(out)
+}
+
+func (n *GzipCompression) Decompress(in io.Reader) io.ReadCloser {
+	r, err := gzip.NewReader(in)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func (n *GzipCompression) AlgName() string {
+	return "gzip"
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/leijurv/gb/config"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 5021))
+	for _, alg := range compressionAlgs {
+		var buf bytes.Buffer
+		c := alg.Compress(&buf)
+		if _, err := c.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() >= len(data) {
+			t.Errorf("%s didn't compress anything", alg.AlgName())
+		}
+		d := alg.Decompress(&buf)
+		result, err := ioutil.ReadAll(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+		if !bytes.Equal(result, data) {
+			t.Errorf("%s round trip gave different data", alg.AlgName())
+		}
+	}
+}
+
+func TestChooseCompression(t *testing.T) {
+	text := []byte(strings.Repeat("owo ", 1000))
+	alg, in := chooseCompression("log.txt", bytes.NewReader(text))
+	if alg == nil {
+		t.Errorf("text should be compressed")
+	}
+	result, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, text) {
+		t.Errorf("sample wasn't put back properly")
+	}
+	alg, _ = chooseCompression("pic.JPG", bytes.NewReader(text))
+	if alg != nil {
+		t.Errorf("jpgs should not be compressed")
+	}
+	alg, _ = chooseCompression("random", bytes.NewReader(randBytes(5021)))
+	if alg != nil {
+		t.Errorf("random data should not be compressed")
+	}
+}
+
+func TestFetchBuffersByUncompressedSize(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		old := config.Config()
+		defer config.SetConfig(old)
+		c := old
+		c.Compression = "zstd"
+		c.ChunkingMinSize = 1 << 40
+		config.SetConfig(c)
+
+		// compresses to almost nothing, but is still too big to hold in memory
+		err := ioutil.WriteFile(filepath.Join(src, "zeros"), make([]byte, catInMemoryLimit+1), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		var hash []byte
+		err = tx.QueryRow("SELECT hash FROM files").Scan(&hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		locations := entryLocations(hash, tx)
+		if len(locations) != 1 {
+			t.Fatalf("expected one location, got %d", len(locations))
+		}
+		if locations[0].length >= catInMemoryLimit {
+			t.Fatalf("expected the entry to be compressed, but it's %d bytes", locations[0].length)
+		}
+		reader, err := locations[0].fetch(hash, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := reader.(*closeOnEOF); !ok {
+			t.Errorf("expected a temp file, got %T", reader)
+		}
+		n, err := io.Copy(ioutil.Discard, reader)
+		if err != nil || n != catInMemoryLimit+1 {
+			t.Errorf("read %d bytes, error %v", n, err)
+		}
+	})
+}
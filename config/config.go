@@ -11,17 +11,59 @@ var HomeDir = os.Getenv("HOME")
 var ConfigLocation = HomeDir + "/.gb.conf"
 
 type ConfigData struct {
-	MinBlobSize      int64  `json:"min_blob_size"`
-	DatabaseLocation string `json:"database_location"`
+	MinBlobSize                 int64          `json:"min_blob_size"`
+	DatabaseLocation            string         `json:"database_location"`
+	StoragePreference           []string       `json:"storage_preference"` // order to try storages in when reading, by label or by type
+	Compression                 string         `json:"compression"`        // zstd, gzip, or none
+	ChunkingMinSize             int64          `json:"chunking_min_size"`  // files at least this big get split into chunks
+	Retention                   Retention      `json:"retention"`
+	Exclude                     []string       `json:"exclude"`                        // gitignore style patterns to leave out of every backup, as if they were in a .gbignore at /
+	HashWorkers                 int            `json:"hash_workers"`                   // how many files to hash at once during a scan
+	HashWorkersPerRoot          map[string]int `json:"hash_workers_per_root"`          // overrides hash_workers for backups of folders in these, e.g. {"/mnt/hdd": 1} for a spinning disk
+	UploadConcurrency           int            `json:"upload_concurrency"`             // how many blobs to upload at once
+	UploadConcurrencyPerStorage map[string]int `json:"upload_concurrency_per_storage"` // lower limits for some storages, by label or by type, e.g. {"Disk": 1}
+}
+
+// how long old versions of files are kept by `gb expire`
+// a version's age is how long ago it stopped being the current version, and the tiers come one after another
+// e.g. keep_all_days 30 and keep_daily_days 60 means one version per day is kept from 30 days ago to 90 days ago
+type Retention struct {
+	KeepAllDays      int64 `json:"keep_all_days"`
+	KeepDailyDays    int64 `json:"keep_daily_days"`
+	KeepWeeklyDays   int64 `json:"keep_weekly_days"`
+	KeepMonthlyDays  int64 `json:"keep_monthly_days"`
+	KeepDeletedDays  int64 `json:"keep_deleted_days"`  // how long to remember files that don't exist anymore at all
+	KeepExcludedDays int64 `json:"keep_excluded_days"` // same, but for files that still exist and were excluded from the backup on purpose
 }
 
 func Config() ConfigData {
 	return config
 }
 
+// for tests that need different settings, set it back afterwards
+func SetConfig(data ConfigData) {
+	config = data
+}
+
 var config = ConfigData{
-	MinBlobSize:      16000000,
-	DatabaseLocation: HomeDir + "/.gb.db",
+	MinBlobSize:                 16000000,
+	DatabaseLocation:            HomeDir + "/.gb.db",
+	StoragePreference:           []string{"Disk", "S3"}, // local is faster and doesn't cost egress
+	Compression:                 "zstd",
+	ChunkingMinSize:             64000000,
+	Exclude:                     []string{},
+	HashWorkers:                 4,
+	HashWorkersPerRoot:          map[string]int{},
+	UploadConcurrency:           4,
+	UploadConcurrencyPerStorage: map[string]int{},
+	Retention: Retention{
+		KeepAllDays:      30,
+		KeepDailyDays:    90,
+		KeepWeeklyDays:   365,
+		KeepMonthlyDays:  3650,
+		KeepDeletedDays:  365,
+		KeepExcludedDays: 365,
+	},
 }
 
 func init() {
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// a folder on a mounted drive
+// identifier is the drive UUID (as in /dev/disk/by-uuid), so that it doesn't matter where the drive happens to get mounted today
+// identifier can also be an absolute path to a mountpoint, for things like network shares that don't have a UUID
+type Disk struct {
+	storageID  []byte
+	identifier string
+	rootPath   string
+
+	mountpoint string
+	mountErr   interface{} // why it couldn't be found, so every later call fails the same way instead of using "" as the mountpoint
+	once       sync.Once
+}
+
+type diskUpload struct {
+	file      *os.File
+	hasher    HasherSizer
+	path      string
+	finalPath string
+	disk      *Disk
+}
+
+// closes the file once it has been read all the way through, since nobody else is going to
+type closeOnEOF struct {
+	reader io.Reader
+	file   *os.File
+}
+
+func (remote *Disk) GetID() []byte {
+	return remote.storageID
+}
+
+func (remote *Disk) niceRootPath() string {
+	path := remote.rootPath
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return path
+}
+
+// where on this computer the drive is mounted right now
+func (remote *Disk) mount() string {
+	remote.once.Do(func() {
+		defer func() {
+			if r := recover(); r != nil {
+				remote.mountErr = r
+			}
+		}()
+		if remote.mountpoint == "" {
+			remote.mountpoint = findMountpoint(remote.identifier)
+		}
+	})
+	if remote.mountErr != nil {
+		panic(remote.mountErr)
+	}
+	return remote.mountpoint
+}
+
+// where on this computer the root path is right now
+func (remote *Disk) base() string {
+	return filepath.Join(remote.mount(), remote.niceRootPath())
+}
+
+func findMountpoint(identifier string) string {
+	if filepath.IsAbs(identifier) {
+		return identifier
+	}
+	device, err := filepath.EvalSymlinks("/dev/disk/by-uuid/" + identifier)
+	if err != nil {
+		log.Println("Unable to find a drive with UUID", identifier, "is it plugged in?")
+		panic(err)
+	}
+	log.Println("Drive", identifier, "is", device)
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		mounted, err := filepath.EvalSymlinks(fields[0])
+		if err != nil || mounted != device {
+			continue
+		}
+		mountpoint := unescapeMountpoint(fields[1])
+		log.Println("Drive", identifier, "is mounted at", mountpoint)
+		return mountpoint
+	}
+	err = scanner.Err()
+	if err != nil {
+		panic(err)
+	}
+	panic("Drive " + identifier + " is plugged in but not mounted")
+}
+
+// /proc/self/mounts escapes spaces and such as octal, e.g. \040
+func unescapeMountpoint(path string) string {
+	var result strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				result.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		result.WriteByte(path[i])
+	}
+	return result.String()
+}
+
+func (remote *Disk) BeginBlobUpload(blobID []byte) StorageUpload {
+	path := remote.niceRootPath() + formatPath(blobID)
+	finalPath := filepath.Join(remote.base(), formatPath(blobID))
+	log.Println("Path is", finalPath)
+	err := os.MkdirAll(filepath.Dir(finalPath), 0755)
+	if err != nil {
+		panic(err)
+	}
+	// write to a temp file next to where it's going, and only rename it into place once it's complete
+	// that way a blob that exists at its real path is always a whole blob
+	f, err := ioutil.TempFile(filepath.Dir(finalPath), ".upload-")
+	if err != nil {
+		panic(err)
+	}
+	return &diskUpload{
+		file:      f,
+		hasher:    NewSHA256HasherSizer(),
+		path:      path,
+		finalPath: finalPath,
+		disk:      remote,
+	}
+}
+
+func (remote *Disk) DownloadSection(blobID []byte, offset int64, length int64) io.Reader {
+	path := filepath.Join(remote.base(), formatPath(blobID))
+	log.Println("Disk path is", path, "reading", length, "bytes at", offset)
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		panic(err)
+	}
+	return &closeOnEOF{io.LimitReader(f, length), f}
+}
+
+func (remote *Disk) Delete(path string) {
+	log.Println("Deleting", path, "from disk")
+	err := os.Remove(filepath.Join(remote.mount(), path))
+	if err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+}
+
+func (remote *Disk) List() []ListedBlob {
+	blobs := make([]ListedBlob, 0)
+	base := remote.base()
+	if _, err := os.Stat(base); os.IsNotExist(err) {
+		return blobs // nothing has been uploaded here yet
+	}
+	err := filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, ListedBlob{remote.niceRootPath() + rel, info.Size()})
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return blobs
+}
+
+func (up *diskUpload) Begin() io.Writer {
+	return io.MultiWriter(up.file, &up.hasher)
+}
+
+func (up *diskUpload) End() CompletedUpload {
+	err := up.file.Sync()
+	if err != nil {
+		panic(err)
+	}
+	err = up.file.Close()
+	if err != nil {
+		panic(err)
+	}
+	err = os.Rename(up.file.Name(), up.finalPath)
+	if err != nil {
+		panic(err)
+	}
+	hash, size := up.hasher.HashAndSize()
+	log.Println("Wrote", size, "bytes to", up.finalPath)
+	return CompletedUpload{
+		path:     up.path,
+		checksum: hex.EncodeToString(hash),
+	}
+}
+
+func (up *diskUpload) Abort() {
+	up.file.Close()
+	os.Remove(up.file.Name())
+}
+
+func (r *closeOnEOF) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil {
+		r.file.Close()
+	}
+	return n, err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskRoundTrip(t *testing.T) {
+	WithTestingDatabase(t, func() {
+		src, err := ioutil.TempDir("", "gb-src-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(src)
+		dest, err := ioutil.TempDir("", "gb-dest-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dest)
+
+		err = ioutil.WriteFile(filepath.Join(src, "a"), []byte("meme"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(src, "b"), make([]byte, 5021), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO storage (storage_id, readable_label, type, identifier, root_path) VALUES (?, ?, ?, ?, ?)", randBytes(32), "test disk", "Disk", dest, "gb/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		upload(backupADirectoryRecursively(src))
+		testAll() // panics on mismatch
+
+		var checksum string
+		var fullPath string
+		err = db.QueryRow("SELECT checksum, full_path FROM blob_storage").Scan(&checksum, &fullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dest, fullPath)); err != nil {
+			t.Error(err)
+		}
+		if len(checksum) != 64 {
+			t.Errorf("expected a hex sha256, got %s", checksum)
+		}
+	})
+}
+
+// a testing database with one Disk storage, and a folder to back up
+func WithDiskStorage(t *testing.T, fn func(src string, dest string)) {
+	WithTestingDatabase(t, func() {
+		src, err := ioutil.TempDir("", "gb-src-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(src)
+		dest, err := ioutil.TempDir("", "gb-dest-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dest)
+		addStorage("test disk", "Disk", dest, "gb/", nil)
+		fn(src, dest)
+	})
+}
+
+// so that each backup in a test gets its own timestamp
+func nextBackup() {
+	now++
+}
+
+func TestUnmountedDiskKeepsFailing(t *testing.T) {
+	cwd, err := ioutil.TempDir("", "gb-cwd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cwd)
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(old)
+	err = os.Chdir(cwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &Disk{storageID: randBytes(32), identifier: "no-such-uuid", rootPath: "gb/"}
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("attempt %d should have panicked since the drive isn't there", i)
+				}
+			}()
+			up := remote.BeginBlobUpload(randBytes(32))
+			up.Begin().Write([]byte("hello"))
+			up.End()
+		}()
+	}
+	if entries, _ := ioutil.ReadDir(cwd); len(entries) != 0 {
+		t.Errorf("nothing should have been written to the current folder, got %d entries", len(entries))
+	}
+}
@@ -4,48 +4,158 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"sort"
 )
 
+// one place that a blob entry can be read from
+type entryLocation struct {
+	blobID      []byte
+	offset      int64
+	length      int64 // in the blob, i.e. after compression
+	size        int64 // of the hash, i.e. before compression
+	compression *string
+	key         []byte
+	label       string
+	storageID   []byte
+	kind        string
+	identifier  string
+	rootPath    string
+}
+
+// anything up to this size gets checked in memory, anything bigger goes through a temp file
+const catInMemoryLimit = 16 * 1024 * 1024
+
 func cat(hash []byte, tx *sql.Tx) io.Reader {
-	var blobID []byte
-	var offset int64
-	var length int64
-	var compression *string
-	var key []byte
-	var fullPath string
-	var storageID []byte
-	var kind string
-	var identifier string
-	var rootPath string
-	// TODO this could return more than one row if the same blob was backed up to more than one destination
-	err := tx.QueryRow(`
+	locations := entryLocations(hash, tx)
+	if len(locations) == 0 {
+		if entryExists(hash, tx) {
+			panic("There's a blob entry for " + hex.EncodeToString(hash) + " but its blob isn't stored anywhere")
+		}
+		chunks := chunkList(hash, tx)
+		if len(chunks) == 0 {
+			panic("No blob entry for " + hex.EncodeToString(hash))
+		}
+		log.Println(hex.EncodeToString(hash), "is split into", len(chunks), "chunks")
+		return &chunksReader{chunks, nil, tx}
+	}
+	for _, location := range locations {
+		reader, err := location.fetch(hash, tx)
+		if err != nil {
+			log.Println("Unable to read", hex.EncodeToString(hash), "from", location.label, "because", err, "so trying the next one")
+			continue
+		}
+		log.Println("Read", hex.EncodeToString(hash), "from", location.label)
+		return reader
+	}
+	panic("Every storage failed to give me " + hex.EncodeToString(hash))
+}
+
+// the same blob can be backed up to more than one destination, so there can be more than one place to read an entry from
+// these are sorted by the configured storage preference
+func entryLocations(hash []byte, tx *sql.Tx) []entryLocation {
+	rows, err := tx.Query(`
 			SELECT
 				blob_entries.blob_id,
-				blob_entries.offset, 
+				blob_entries.offset,
 				blob_entries.final_size,
+				hashes.size,
 				blob_entries.compression_alg,
 				blobs.encryption_key,
-				blob_storage.full_path,
+				storage.readable_label,
 				storage.storage_id,
 				storage.type,
 				storage.identifier,
 				storage.root_path
 			FROM blob_entries
+				INNER JOIN hashes ON hashes.hash = blob_entries.hash
 				INNER JOIN blobs ON blobs.blob_id = blob_entries.blob_id
 				INNER JOIN blob_storage ON blob_storage.blob_id = blobs.blob_id
 				INNER JOIN storage ON storage.storage_id = blob_storage.storage_id
 			WHERE blob_entries.hash = ?
-		`, hash).Scan(&blobID, &offset, &length, &compression, &key, &fullPath, &storageID, &kind, &identifier, &rootPath)
+		`, hash)
 	if err != nil {
 		panic(err)
 	}
-	storage := StorageDataToStorage(storageID, kind, identifier, rootPath)
-	reader := storage.DownloadSection(blobID, offset, length)
-	decrypted := DecryptBlobEntry(reader, offset, key)
-	return decrypted
+	defer rows.Close()
+	locations := make([]entryLocation, 0)
+	for rows.Next() {
+		var loc entryLocation
+		err := rows.Scan(&loc.blobID, &loc.offset, &loc.length, &loc.size, &loc.compression, &loc.key, &loc.label, &loc.storageID, &loc.kind, &loc.identifier, &loc.rootPath)
+		if err != nil {
+			panic(err)
+		}
+		locations = append(locations, loc)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	sort.SliceStable(locations, func(i, j int) bool {
+		return storagePreference(locations[i].label, locations[i].kind) < storagePreference(locations[j].label, locations[j].kind)
+	})
+	return locations
+}
+
+// read the whole entry from this location and check it against the hash before giving any of it back
+// storages panic when they have problems, so that gets turned into an error here too
+func (loc entryLocation) fetch(hash []byte, tx *sql.Tx) (result io.Reader, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	storage := StorageDataToStorage(loc.storageID, loc.kind, loc.identifier, loc.rootPath, tx)
+	reader := storage.DownloadSection(loc.blobID, loc.offset, loc.length)
+	var decrypted io.Reader = DecryptBlobEntry(reader, loc.offset, loc.key)
+	if loc.compression != nil {
+		decompressor := CompressionByName(*loc.compression).Decompress(decrypted)
+		defer decompressor.Close()
+		decrypted = decompressor
+	}
+
+	var buf *bytes.Buffer
+	var tmp *os.File
+	var out io.Writer
+	if loc.size <= catInMemoryLimit { // not length, a small compressed entry can decompress into something huge
+		buf = new(bytes.Buffer)
+		out = buf
+	} else {
+		tmp, err = ioutil.TempFile("", "gb-cat-")
+		if err != nil {
+			panic(err)
+		}
+		os.Remove(tmp.Name()) // it'll stick around until closed
+		out = tmp
+	}
+	closeTmp := func() {
+		if tmp != nil {
+			tmp.Close()
+		}
+	}
+	h := NewSHA256HasherSizer()
+	if _, err := io.Copy(io.MultiWriter(out, &h), decrypted); err != nil {
+		closeTmp()
+		return nil, err
+	}
+	realHash, realSize := h.HashAndSize()
+	if !bytes.Equal(realHash, hash) {
+		closeTmp()
+		return nil, fmt.Errorf("hash mismatch, got %s with size %d", hex.EncodeToString(realHash), realSize)
+	}
+	if buf != nil {
+		return buf, nil
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		closeTmp()
+		return nil, err
+	}
+	return &closeOnEOF{tmp, tmp}, nil
 }
 
 func downloadOne(hash []byte) {
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/leijurv/gb/config"
+)
+
+func withStoragePreference(prefs []string, fn func()) {
+	old := config.Config()
+	defer config.SetConfig(old)
+	c := old
+	c.StoragePreference = prefs
+	config.SetConfig(c)
+	fn()
+}
+
+func catString(t *testing.T, hash []byte) string {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Commit()
+	data, err := ioutil.ReadAll(cat(hash, tx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCatFallsBackToAnotherStorage(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		other, err := ioutil.TempDir("", "gb-dest-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(other)
+		addStorage("other disk", "Disk", other, "gb/", nil)
+		contents := strings.Repeat("the quick brown fox ", 100)
+		err = ioutil.WriteFile(filepath.Join(src, "a"), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+		var hash []byte
+		err = db.QueryRow("SELECT hash FROM files").Scan(&hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, prefs := range [][]string{{"test disk", "other disk"}, {"other disk"}, {"S3", "Disk"}} {
+			withStoragePreference(prefs, func() {
+				tx, err := db.Begin()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer tx.Commit()
+				locations := entryLocations(hash, tx)
+				if len(locations) != 2 {
+					t.Fatalf("expected it on both storages, got %d", len(locations))
+				}
+				expected := "test disk"
+				if prefs[0] == "other disk" {
+					expected = "other disk"
+				}
+				if locations[0].label != expected {
+					t.Errorf("with preference %v, expected to read from %s first, got %s", prefs, expected, locations[0].label)
+				}
+			})
+		}
+
+		withStoragePreference([]string{"test disk", "other disk"}, func() {
+			var fullPath string
+			err := db.QueryRow("SELECT blob_storage.full_path FROM blob_storage INNER JOIN storage ON storage.storage_id = blob_storage.storage_id WHERE storage.readable_label = ?", "test disk").Scan(&fullPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blob, err := ioutil.ReadFile(filepath.Join(dest, fullPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			corrupted := bytes.Repeat([]byte{0}, len(blob))
+			err = ioutil.WriteFile(filepath.Join(dest, fullPath), corrupted, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data := catString(t, hash); data != contents {
+				t.Errorf("should have read the good copy from the other disk, got %q", data)
+			}
+
+			// and if it's gone from there too, that should be an error rather than wrong data
+			_, err = db.Exec("DELETE FROM blob_storage WHERE storage_id = (SELECT storage_id FROM storage WHERE readable_label = ?)", "other disk")
+			if err != nil {
+				t.Fatal(err)
+			}
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("the only copy left is corrupted, so this should have failed")
+					}
+				}()
+				catString(t, hash)
+			}()
+		})
+	})
+}
+
+func TestCatEntryNotStoredAnywhere(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		err := ioutil.WriteFile(filepath.Join(src, "a"), []byte("aaa"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+		var hash []byte
+		err = db.QueryRow("SELECT hash FROM files").Scan(&hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("DELETE FROM blob_storage")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			r := recover()
+			if msg, ok := r.(string); !ok || !strings.Contains(msg, "isn't stored anywhere") {
+				t.Errorf("expected to be told the blob isn't stored anywhere, got %v", r)
+			}
+		}()
+		catString(t, hash)
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// invariants that span tables, which the schema can't check by itself
+// each query gives one description per violation
+var fsckChecks = []struct {
+	kind  string
+	query string
+}{
+	{"current files with nothing uploaded", `
+		SELECT files.path || ' ' || LOWER(HEX(files.hash))
+		FROM files
+		WHERE files.end IS NULL
+			AND NOT EXISTS (SELECT 1 FROM blob_entries WHERE blob_entries.hash = files.hash)
+			AND NOT EXISTS (SELECT 1 FROM file_chunks WHERE file_chunks.hash = files.hash)
+	`},
+	{"chunks with nothing uploaded", `
+		SELECT DISTINCT LOWER(HEX(file_chunks.chunk_hash)) || ' of ' || LOWER(HEX(file_chunks.hash))
+		FROM file_chunks
+		WHERE NOT EXISTS (SELECT 1 FROM blob_entries WHERE blob_entries.hash = file_chunks.chunk_hash)
+	`},
+	{"blobs that aren't stored anywhere", `
+		SELECT LOWER(HEX(blobs.blob_id))
+		FROM blobs
+		WHERE NOT EXISTS (SELECT 1 FROM blob_storage WHERE blob_storage.blob_id = blobs.blob_id)
+	`},
+	{"entries that don't fit in their blob", `
+		SELECT LOWER(HEX(blob_entries.hash)) || ' at ' || blob_entries.offset || ' with length ' || blob_entries.final_size || ' in ' || LOWER(HEX(blobs.blob_id)) || ' which is only ' || blobs.size || ' bytes'
+		FROM blob_entries
+			INNER JOIN blobs ON blobs.blob_id = blob_entries.blob_id
+		WHERE blob_entries.offset + blob_entries.final_size > blobs.size
+	`},
+}
+
+// runs every check and prints what's wrong, grouped by kind
+// returns how many problems there are
+func fsck() int {
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		err = tx.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	total := 0
+	for _, check := range fsckChecks {
+		log.Println("Checking for", check.kind)
+		total += printViolations(check.kind, queryViolations(check.query, tx))
+	}
+	log.Println("Checking for overlapping entries")
+	total += printViolations("entries that overlap", overlappingEntries(tx))
+	if total == 0 {
+		fmt.Println("Everything is consistent")
+	} else {
+		fmt.Println(total, "problems")
+	}
+	return total
+}
+
+func queryViolations(query string, tx *sql.Tx) []string {
+	rows, err := tx.Query(query)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	violations := make([]string, 0)
+	for rows.Next() {
+		var violation string
+		err := rows.Scan(&violation)
+		if err != nil {
+			panic(err)
+		}
+		violations = append(violations, violation)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return violations
+}
+
+// done here instead of in sql since it needs to compare each entry to the one before it in the blob
+func overlappingEntries(tx *sql.Tx) []string {
+	rows, err := tx.Query("SELECT blob_id, hash, offset, final_size FROM blob_entries ORDER BY blob_id, offset")
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	violations := make([]string, 0)
+	var prevBlobID []byte
+	var prevHash []byte
+	var prevEnd int64
+	for rows.Next() {
+		var blobID []byte
+		var hash []byte
+		var offset int64
+		var length int64
+		err := rows.Scan(&blobID, &hash, &offset, &length)
+		if err != nil {
+			panic(err)
+		}
+		if prevBlobID != nil && string(blobID) == string(prevBlobID) && offset < prevEnd {
+			violations = append(violations, hex.EncodeToString(hash)+" at "+strconv.FormatInt(offset, 10)+" starts before "+hex.EncodeToString(prevHash)+" ends at "+strconv.FormatInt(prevEnd, 10)+" in "+hex.EncodeToString(blobID))
+		}
+		if prevBlobID == nil || string(blobID) != string(prevBlobID) || offset+length > prevEnd {
+			prevEnd = offset + length
+			prevHash = hash
+		}
+		prevBlobID = blobID
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return violations
+}
+
+func printViolations(kind string, violations []string) int {
+	if len(violations) == 0 {
+		return 0
+	}
+	fmt.Println(len(violations), kind+":")
+	for _, violation := range violations {
+		fmt.Println("  " + violation)
+	}
+	return len(violations)
+}
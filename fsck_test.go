@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		err := ioutil.WriteFile(filepath.Join(src, "a"), []byte("aaa"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(src, "b"), []byte("bbb"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+		if n := fsck(); n != 0 {
+			t.Fatalf("a normal backup should be consistent, got %d problems", n)
+		}
+
+		// a file that was scanned but never uploaded
+		err = ioutil.WriteFile(filepath.Join(src, "c"), []byte("ccc"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nextBackup()
+		backupADirectoryRecursively(src)
+
+		// a blob that isn't on any storage, with entries that overlap and one that goes past the end
+		blobID := randBytes(32)
+		_, err = db.Exec("INSERT INTO blobs (blob_id, encryption_key, size, hash_pre_enc, hash_post_enc) VALUES (?, ?, 100, ?, ?)", blobID, randBytes(16), randBytes(32), randBytes(32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range []struct{ offset, length int64 }{{0, 60}, {50, 20}, {90, 20}} {
+			hash := randBytes(32)
+			_, err = db.Exec("INSERT INTO hashes (hash, size) VALUES (?, ?)", hash, entry.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.Exec("INSERT INTO blob_entries (hash, blob_id, final_size, offset) VALUES (?, ?, ?, ?)", hash, blobID, entry.length, entry.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// a chunk list with a chunk that was never uploaded
+		whole := randBytes(32)
+		chunk := randBytes(32)
+		for _, hash := range [][]byte{whole, chunk} {
+			_, err = db.Exec("INSERT INTO hashes (hash, size) VALUES (?, 10)", hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = db.Exec("INSERT INTO file_chunks (hash, idx, chunk_hash, offset) VALUES (?, 0, ?, 0)", whole, chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n := fsck(); n != 5 {
+			t.Errorf("expected 5 problems, got %d", n)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		for _, check := range fsckChecks {
+			expected := map[string]int{
+				"current files with nothing uploaded":  1,
+				"chunks with nothing uploaded":         1,
+				"blobs that aren't stored anywhere":    1,
+				"entries that don't fit in their blob": 1,
+			}[check.kind]
+			if n := len(queryViolations(check.query, tx)); n != expected {
+				t.Errorf("expected %d %s, got %d", expected, check.kind, n)
+			}
+		}
+		if n := len(overlappingEntries(tx)); n != 1 {
+			t.Errorf("expected 1 overlap, got %d", n)
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"log"
+)
+
+// a blob that nothing needs anymore, and everywhere it's stored
+type garbageBlob struct {
+	blobID    []byte
+	size      int64
+	locations []blobStorageRow
+}
+
+type blobStorageRow struct {
+	storageID []byte
+	fullPath  string
+}
+
+// hashes that some files row (current or historical) still needs, either directly or as a chunk of a file
+const liveHashes = `
+	SELECT hash FROM files
+	UNION
+	SELECT file_chunks.chunk_hash FROM file_chunks INNER JOIN files ON files.hash = file_chunks.hash
+`
+
+// delete every blob that has no entries that any files row still refers to
+// from every storage first, then from the database
+func gc(dryRun bool) {
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		log.Println("Committing to database")
+		err = tx.Commit()
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Done")
+	}()
+	garbage := findGarbageBlobs(tx)
+	total := int64(0)
+	for _, blob := range garbage {
+		total += blob.size
+	}
+	log.Println("There are", len(garbage), "blobs that nothing refers to anymore, totaling", total, "bytes")
+	if dryRun {
+		for _, blob := range garbage {
+			log.Println("Would delete", hex.EncodeToString(blob.blobID), "with size", blob.size, "from", len(blob.locations), "storages")
+		}
+		return
+	}
+	deleteBlobs(garbage, tx)
+	deleteDeadChunkLists(tx)
+	pruneOrphanedHashes(tx)
+}
+
+func findGarbageBlobs(tx *sql.Tx) []garbageBlob {
+	rows, err := tx.Query(`
+		SELECT blobs.blob_id, blobs.size
+		FROM blobs
+		WHERE NOT EXISTS (
+			SELECT 1 FROM blob_entries
+			WHERE blob_entries.blob_id = blobs.blob_id AND blob_entries.hash IN (` + liveHashes + `)
+		)
+	`)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	garbage := make([]garbageBlob, 0)
+	for rows.Next() {
+		var blob garbageBlob
+		err := rows.Scan(&blob.blobID, &blob.size)
+		if err != nil {
+			panic(err)
+		}
+		garbage = append(garbage, blob)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	rows.Close()
+	for i := range garbage {
+		garbage[i].locations = blobStorageRows(garbage[i].blobID, tx)
+	}
+	return garbage
+}
+
+func blobStorageRows(blobID []byte, tx *sql.Tx) []blobStorageRow {
+	rows, err := tx.Query("SELECT storage_id, full_path FROM blob_storage WHERE blob_id = ?", blobID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	locations := make([]blobStorageRow, 0)
+	for rows.Next() {
+		var location blobStorageRow
+		err := rows.Scan(&location.storageID, &location.fullPath)
+		if err != nil {
+			panic(err)
+		}
+		locations = append(locations, location)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return locations
+}
+
+// deletes these blobs from every storage, then from the database
+// if deleting from a storage fails, this panics before the transaction is committed, so the database still knows about everything that's still out there
+func deleteBlobs(blobs []garbageBlob, tx *sql.Tx) {
+	storages := make(map[string]Storage)
+	for _, storage := range GetAll(tx) {
+		storages[string(storage.GetID())] = storage
+	}
+	for _, blob := range blobs {
+		log.Println("Deleting blob", hex.EncodeToString(blob.blobID))
+		for _, location := range blob.locations {
+			storages[string(location.storageID)].Delete(location.fullPath)
+		}
+	}
+	for _, blob := range blobs {
+		_, err := tx.Exec("DELETE FROM blob_storage WHERE blob_id = ?", blob.blobID)
+		if err != nil {
+			panic(err)
+		}
+		_, err = tx.Exec("DELETE FROM blob_entries WHERE blob_id = ?", blob.blobID)
+		if err != nil {
+			panic(err)
+		}
+		_, err = tx.Exec("DELETE FROM blobs WHERE blob_id = ?", blob.blobID)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// chunk lists of files that no files row refers to anymore
+func deleteDeadChunkLists(tx *sql.Tx) {
+	result, err := tx.Exec("DELETE FROM file_chunks WHERE hash NOT IN (SELECT hash FROM files)")
+	if err != nil {
+		panic(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	log.Println("Deleted", n, "chunk list rows of files that no longer exist")
+}
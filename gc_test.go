@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func storedObjects(t *testing.T, dest string) int {
+	n := 0
+	err := filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestGc(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		err := ioutil.WriteFile(filepath.Join(src, "a"), []byte("aaa"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(src, "b"), []byte("bbb"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+		if n := countRows(t, "SELECT COUNT(*) FROM blobs"); n != 1 {
+			t.Fatalf("expected both files in one blob, got %d blobs", n)
+		}
+
+		_, err = db.Exec("DELETE FROM files WHERE path = ?", filepath.Join(src, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gc(false)
+		if n := countRows(t, "SELECT COUNT(*) FROM blobs"); n != 1 {
+			t.Fatalf("b still needs the blob, but there are %d blobs", n)
+		}
+		if n := storedObjects(t, dest); n != 1 {
+			t.Fatalf("b still needs the blob, but there are %d objects on disk", n)
+		}
+		testAll()
+
+		_, err = db.Exec("DELETE FROM files WHERE path = ?", filepath.Join(src, "b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gc(true)
+		if n := storedObjects(t, dest); n != 1 {
+			t.Fatalf("a dry run shouldn't delete anything, but there are %d objects on disk", n)
+		}
+		gc(false)
+		for _, table := range []string{"blobs", "blob_entries", "blob_storage", "hashes"} {
+			if n := countRows(t, "SELECT COUNT(*) FROM "+table); n != 0 {
+				t.Errorf("expected %s to be empty, got %d rows", table, n)
+			}
+		}
+		if n := storedObjects(t, dest); n != 0 {
+			t.Errorf("expected the blob to be deleted from disk, but there are %d objects", n)
+		}
+	})
+}
+
+func TestGcKeepsChunks(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		withChunkingMinSize(1, func() {
+			path := filepath.Join(src, "big")
+			data := randBytes(2*chunkMaxSize + 1)
+			err := ioutil.WriteFile(path, data, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			upload(backupADirectoryRecursively(src))
+
+			// the second version shares most of its chunks with the first, so they stay in the first blob
+			nextBackup()
+			err = ioutil.WriteFile(path, append([]byte("hello"), data...), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			later := time.Now().Add(time.Hour)
+			err = os.Chtimes(path, later, later)
+			if err != nil {
+				t.Fatal(err)
+			}
+			upload(backupADirectoryRecursively(src))
+			if n := countRows(t, "SELECT COUNT(*) FROM blobs"); n != 2 {
+				t.Fatalf("expected 2 blobs, got %d", n)
+			}
+
+			// nothing in files refers to the first blob anymore, only the second version's chunk list does
+			_, err = db.Exec("DELETE FROM files WHERE path = ? AND end IS NOT NULL", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gc(false)
+			if n := countRows(t, "SELECT COUNT(*) FROM blobs"); n != 2 {
+				t.Fatalf("the first blob still has chunks of the second version, but there are %d blobs", n)
+			}
+			if n := storedObjects(t, dest); n != 2 {
+				t.Fatalf("expected 2 objects on disk, got %d", n)
+			}
+			testAll()
+
+			_, err = db.Exec("DELETE FROM files WHERE path = ?", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gc(false)
+			for _, table := range []string{"blobs", "blob_entries", "blob_storage", "file_chunks", "hashes"} {
+				if n := countRows(t, "SELECT COUNT(*) FROM "+table); n != 0 {
+					t.Errorf("expected %s to be empty, got %d rows", table, n)
+				}
+			}
+			if n := storedObjects(t, dest); n != 0 {
+				t.Errorf("expected nothing left on disk, got %d objects", n)
+			}
+		})
+	})
+}
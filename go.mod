@@ -3,6 +3,7 @@ module github.com/leijurv/gb
 go 1.13
 
 require (
+	github.com/DataDog/zstd v1.4.1
 	github.com/aws/aws-sdk-go v1.25.26
 	github.com/mattn/go-sqlite3 v1.11.0
 )
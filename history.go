@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type historyEntry struct {
+	start    int64
+	end      *int64
+	size     int64
+	hash     []byte
+	uploaded bool
+}
+
+func history(path string, tx *sql.Tx) []historyEntry {
+	rows, err := tx.Query(`
+		SELECT
+			files.start,
+			files.end,
+			hashes.size,
+			files.hash,
+			EXISTS(SELECT 1 FROM blob_entries WHERE blob_entries.hash = files.hash) OR EXISTS(SELECT 1 FROM file_chunks WHERE file_chunks.hash = files.hash)
+		FROM files
+			INNER JOIN hashes ON hashes.hash = files.hash
+		WHERE files.path = ? /* uses files_by_path */
+		ORDER BY files.start
+	`, path)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	versions := make([]historyEntry, 0)
+	for rows.Next() {
+		var version historyEntry
+		err := rows.Scan(&version.start, &version.end, &version.size, &version.hash, &version.uploaded)
+		if err != nil {
+			panic(err)
+		}
+		versions = append(versions, version)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return versions
+}
+
+func formatTimestamp(timestamp int64) string {
+	return time.Unix(timestamp, 0).Format("2006-01-02 15:04:05")
+}
+
+// list every version of this file, or if version is given (counting from 1), cat it or restore it to the given path
+func showHistory(path string, version int, catIt bool, restoreTo string) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		panic(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		err = tx.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	versions := history(path, tx)
+	if len(versions) == 0 {
+		usageError("No history for", path)
+	}
+	if version == 0 {
+		for i, v := range versions {
+			end := "now"
+			if v.end != nil {
+				end = formatTimestamp(*v.end)
+			}
+			uploaded := "uploaded"
+			if !v.uploaded {
+				uploaded = "NOT uploaded yet"
+			}
+			fmt.Printf("%d\t%s\tto %s\t%d bytes\t%s\t%s\n", i+1, formatTimestamp(v.start), end, v.size, hex.EncodeToString(v.hash), uploaded)
+		}
+		return
+	}
+	if version < 1 || version > len(versions) {
+		usageError("There are only", len(versions), "versions of", path)
+	}
+	chosen := versions[version-1]
+	if !chosen.uploaded {
+		usageError("Version", version, "of", path, "was never uploaded")
+	}
+	if catIt {
+		if _, err := io.Copy(os.Stdout, cat(chosen.hash, tx)); err != nil {
+			panic(err)
+		}
+	}
+	if restoreTo != "" {
+		if !restoreFile(chosen.hash, restoreTo, loadMetadata(path, chosen.start, tx), tx) {
+			os.Exit(1)
+		}
+		log.Println("Restored version", version, "of", path, "to", restoreTo)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		path := filepath.Join(src, "a")
+		starts := make([]int64, 0)
+		for i, contents := range []string{"one", "version two", "three!!"} {
+			if i > 0 {
+				nextBackup()
+			}
+			err := ioutil.WriteFile(path, []byte(contents), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			modified := time.Unix(now+int64(i)*100, 0)
+			err = os.Chtimes(path, modified, modified)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hashLater := backupADirectoryRecursively(src)
+			if i < 2 {
+				upload(hashLater) // the last version is only scanned
+			}
+			starts = append(starts, now)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions := history(path, tx)
+		tx.Commit()
+		if len(versions) != 3 {
+			t.Fatalf("expected 3 versions, got %d", len(versions))
+		}
+		for i, v := range versions {
+			if v.start != starts[i] {
+				t.Errorf("version %d: expected start %d, got %d", i+1, starts[i], v.start)
+			}
+			if i < 2 && (v.end == nil || *v.end != starts[i+1]) {
+				t.Errorf("version %d: expected it to end when the next one started", i+1)
+			}
+			if i == 2 && v.end != nil {
+				t.Errorf("the last version should be current")
+			}
+			if v.uploaded != (i < 2) {
+				t.Errorf("version %d: expected uploaded to be %v", i+1, i < 2)
+			}
+		}
+		if versions[1].size != int64(len("version two")) {
+			t.Errorf("expected version 2 to be %d bytes, got %d", len("version two"), versions[1].size)
+		}
+
+		out := filepath.Join(dest, "restored")
+		showHistory(path, 2, false, out)
+		data, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "version two" {
+			t.Errorf("expected version two, got %q", data)
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leijurv/gb/config"
+)
+
+// a .gbignore works like a .gitignore:
+// blank lines and lines starting with # are skipped
+// a pattern ending in / only matches directories
+// a pattern starting with ! brings back something an earlier pattern excluded (but not if a whole folder above it was excluded)
+// a pattern with a / anywhere but the end is relative to the folder the .gbignore is in, otherwise it matches a name at any depth
+// * and ? and [abc] work within one path segment, and ** matches any number of segments
+// the exclude patterns in the config work the same way, as if they were a .gbignore at /
+const ignoreFileName = ".gbignore"
+
+type ignoreRule struct {
+	base     string   // folder this rule is relative to, with a trailing slash
+	segments []string // pattern split on /
+	anchored bool
+	dirOnly  bool
+	negate   bool
+}
+
+type Ignorer struct {
+	rules map[string][]ignoreRule // by base folder
+
+	// everything that got excluded during this scan
+	excludedDirs  []string // with a trailing slash
+	excludedFiles map[string]bool
+}
+
+func NewIgnorer() *Ignorer {
+	ig := &Ignorer{
+		rules:         make(map[string][]ignoreRule),
+		excludedFiles: make(map[string]bool),
+	}
+	for _, line := range config.Config().Exclude {
+		ig.addRule("/", line)
+	}
+	return ig
+}
+
+// read the .gbignore in this folder, if there is one
+func (ig *Ignorer) loadDir(dir string) {
+	f, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Unable to read", filepath.Join(dir, ignoreFileName), "so not excluding anything based on it:", err)
+		}
+		return
+	}
+	defer f.Close()
+	base := strings.TrimSuffix(dir, "/") + "/"
+	scanner := bufio.NewScanner(f)
+	lines := make([]string, 0)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	err = scanner.Err()
+	if err != nil {
+		// e.g. a line too long to be a pattern, so this probably isn't really a .gbignore
+		log.Println("Unable to read", filepath.Join(dir, ignoreFileName), "so not excluding anything based on it:", err)
+		return
+	}
+	for _, line := range lines {
+		ig.addRule(base, line)
+	}
+	log.Println("Loaded", len(ig.rules[base]), "exclude rules from", filepath.Join(dir, ignoreFileName))
+}
+
+func (ig *Ignorer) addRule(base string, line string) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return
+	}
+	rule.segments = strings.Split(line, "/")
+	ig.rules[base] = append(ig.rules[base], rule)
+}
+
+// whether this should be left out of the backup, according to the config and every .gbignore loaded so far in the folders above it
+// later rules win over earlier ones, and deeper .gbignore files win over shallower ones
+func (ig *Ignorer) ignored(path string, isDir bool) bool {
+	path = strings.TrimSuffix(path, "/")
+	ignored := false
+	for _, base := range ancestors(path) {
+		for _, rule := range ig.rules[base] {
+			if rule.matches(path, isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// every folder above this path, starting from /, each with a trailing slash
+func ancestors(path string) []string {
+	result := []string{"/"}
+	for i := 1; i < len(path); i++ {
+		if path[i] == '/' {
+			result = append(result, path[:i+1])
+		}
+	}
+	return result
+}
+
+func (rule ignoreRule) matches(path string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	if !strings.HasPrefix(path, rule.base) {
+		return false
+	}
+	segments := strings.Split(path[len(rule.base):], "/")
+	if !rule.anchored {
+		// the folders above were already checked on the way down, so only the name is left to check
+		return matchSegments(rule.segments, segments[len(segments)-1:])
+	}
+	return matchSegments(rule.segments, segments)
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, err := filepath.Match(pattern[0], segments[0])
+	if err != nil {
+		// malformed pattern, like an unclosed [
+		return false
+	}
+	return ok && matchSegments(pattern[1:], segments[1:])
+}
+
+func (ig *Ignorer) exclude(path string, isDir bool) {
+	if isDir {
+		log.Println("Excluding", path, "and everything in it")
+		ig.excludedDirs = append(ig.excludedDirs, strings.TrimSuffix(path, "/")+"/")
+	} else {
+		log.Println("Excluding", path)
+		ig.excludedFiles[path] = true
+	}
+}
+
+// whether this path was left out on purpose during this scan
+func (ig *Ignorer) wasExcluded(path string) bool {
+	if ig.excludedFiles[path] {
+		return true
+	}
+	for _, dir := range ig.excludedDirs {
+		if strings.HasPrefix(path, dir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIgnorer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gb-ignore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, ignoreFileName), []byte("# comment\n*.o\n!keep.o\nbuild/\n/top.txt\ndocs/**/*.tmp\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", ignoreFileName), []byte("!other.o\n"), 0644)
+
+	ig := NewIgnorer()
+	ig.addRule("/", "node_modules/")
+	ig.loadDir(dir)
+	ig.loadDir(filepath.Join(dir, "sub"))
+
+	cases := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.o", false, true},
+		{"sub/a.o", false, true},
+		{"keep.o", false, false},
+		{"sub/other.o", false, false},
+		{"build", true, true},
+		{"build", false, false}, // only folders
+		{"sub/build", true, true},
+		{"top.txt", false, true},
+		{"sub/top.txt", false, false}, // anchored
+		{"docs/x.tmp", false, true},
+		{"docs/a/b/x.tmp", false, true},
+		{"x.tmp", false, false},
+		{"sub/node_modules", true, true},
+		{"sub/readme", false, false},
+	}
+	for _, c := range cases {
+		if got := ig.ignored(filepath.Join(dir, c.path), c.isDir); got != c.ignored {
+			t.Errorf("%s (dir %v): ignored was %v, expected %v", c.path, c.isDir, got, c.ignored)
+		}
+	}
+}
+
+func TestExcludedFilesEnd(t *testing.T) {
+	WithTestingDatabase(t, func() {
+		src, err := ioutil.TempDir("", "gb-src-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(src)
+		err = os.MkdirAll(filepath.Join(src, "node_modules", "x"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(src, "a"), []byte("aaa"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(src, "node_modules", "x", "b"), []byte("bbb"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(src, "gone"), []byte("gone"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backupADirectoryRecursively(src)
+		if n := countRows(t, "SELECT COUNT(*) FROM files WHERE end IS NULL"); n != 3 {
+			t.Fatalf("expected 3 files, got %d", n)
+		}
+
+		nextBackup()
+		err = ioutil.WriteFile(filepath.Join(src, ignoreFileName), []byte("node_modules/\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Remove(filepath.Join(src, "gone"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		backupADirectoryRecursively(src)
+		if n := countRows(t, "SELECT COUNT(*) FROM files WHERE end IS NULL"); n != 2 {
+			t.Fatalf("expected only a and the .gbignore to be current, got %d", n)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM excluded WHERE path = ?", filepath.Join(src, "node_modules", "x", "b")); n != 1 {
+			t.Errorf("b should be remembered as excluded")
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM excluded"); n != 1 {
+			t.Errorf("only b was excluded, the deleted file wasn't, but there are %d rows", n)
+		}
+	})
+}
+
+func TestUnreadableIgnoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gb-ignore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, ignoreFileName), []byte("a\n"+strings.Repeat("x", 100000)+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ig := NewIgnorer()
+	ig.loadDir(dir) // shouldn't panic
+	if ig.ignored(filepath.Join(dir, "a"), false) {
+		t.Errorf("none of a broken .gbignore should be used, not even the lines before the broken one")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// a subfolder, folded up into one line
+type lsDir struct {
+	files int64
+	size  int64
+}
+
+// show what was in this folder at this time
+func ls(path string, at int64, recursive bool) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		panic(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		err = tx.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	lines := lsLines(path, at, recursive, tx)
+	if len(lines) == 0 {
+		usageError("Nothing was backed up under", path, "at", formatTimestamp(at))
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+// what ls shows, one line per file, or per subfolder unless recursive
+func lsLines(path string, at int64, recursive bool, tx *sql.Tx) []string {
+	dir := strings.TrimSuffix(path, "/") + "/"
+	files := filesAt(path, at, tx)
+	lines := make([]string, 0)
+	dirs := make(map[string]*lsDir)
+	for _, file := range files {
+		if file.path == path {
+			// it's a file, not a folder
+			lines = append(lines, fmt.Sprintf("%s\t%d\t%s", formatTimestamp(file.start), file.size, file.path))
+			continue
+		}
+		rel := strings.TrimPrefix(file.path, dir)
+		if !recursive {
+			if i := strings.Index(rel, "/"); i != -1 {
+				name := rel[:i+1]
+				if _, ok := dirs[name]; !ok {
+					dirs[name] = &lsDir{}
+				}
+				dirs[name].files++
+				dirs[name].size += file.size
+				continue
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%s\t%d\t%s", formatTimestamp(file.start), file.size, rel))
+	}
+	names := make([]string, 0)
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%d files\t%d\t%s", dirs[name].files, dirs[name].size, name))
+	}
+	return lines
+}
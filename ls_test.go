@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// a files row with made up contents of this size
+func insertVersion(t *testing.T, path string, size int64, start int64, end *int64) {
+	hash := randBytes(32)
+	_, err := db.Exec("INSERT INTO hashes (hash, size) VALUES (?, ?)", hash, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO files (path, hash, start, end, fs_modified) VALUES (?, ?, ?, ?, ?)", path, hash, start, end, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func int64Ptr(n int64) *int64 {
+	return &n
+}
+
+func TestLs(t *testing.T) {
+	WithTestingDatabase(t, func() {
+		insertVersion(t, "/src/a", 1, 100, nil)
+		insertVersion(t, "/src/d/b", 2, 100, int64Ptr(200))
+		insertVersion(t, "/src/d/e/c", 3, 150, nil)
+		insertVersion(t, "/src/old", 4, 50, int64Ptr(100))
+		insertVersion(t, "/srcother/x", 5, 50, nil)
+
+		line := func(start int64, size int64, name string) string {
+			return fmt.Sprintf("%s\t%d\t%s", formatTimestamp(start), size, name)
+		}
+		for _, c := range []struct {
+			path      string
+			at        int64
+			recursive bool
+			expected  []string
+		}{
+			// c hasn't started yet, old has just ended
+			{"/src", 100, false, []string{line(100, 1, "a"), "1 files\t2\td/"}},
+			{"/src", 99, false, []string{line(50, 4, "old")}},
+			{"/src", 150, false, []string{line(100, 1, "a"), "2 files\t5\td/"}},
+			{"/src", 150, true, []string{line(100, 1, "a"), line(100, 2, "d/b"), line(150, 3, "d/e/c")}},
+			// b has ended
+			{"/src", 200, true, []string{line(100, 1, "a"), line(150, 3, "d/e/c")}},
+			{"/src/d", 150, false, []string{line(100, 2, "b"), "1 files\t3\te/"}},
+			{"/src/a", 150, false, []string{line(100, 1, "/src/a")}},
+			{"/src", 49, false, []string{}},
+		} {
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := lsLines(c.path, c.at, c.recursive, tx)
+			tx.Commit()
+			if !reflect.DeepEqual(lines, c.expected) {
+				t.Errorf("ls %s at %d (recursive %v): expected %q, got %q", c.path, c.at, c.recursive, c.expected, lines)
+			}
+		}
+	})
+}
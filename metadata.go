@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"log"
+	"os"
+	"time"
+)
+
+// everything about a file other than its contents, that should come back when it's restored
+type fileMetadata struct {
+	mode    os.FileMode
+	uid     *int64 // nil where there's no such thing (windows)
+	gid     *int64
+	mtimeNs int64
+	rdev    *int64 // device number, only for device files
+	xattrs  map[string][]byte
+}
+
+func readMetadata(path string, info os.FileInfo) fileMetadata {
+	meta := fileMetadata{
+		mode:    info.Mode(),
+		mtimeNs: info.ModTime().UnixNano(),
+	}
+	meta.uid, meta.gid, meta.rdev = statOwner(info)
+	if info.Mode().IsRegular() {
+		meta.xattrs = readXattrs(path)
+	}
+	return meta
+}
+
+// whether these are the same, other than mtime
+func (meta fileMetadata) sameAs(other fileMetadata) bool {
+	if meta.mode != other.mode || !sameInt(meta.uid, other.uid) || !sameInt(meta.gid, other.gid) || !sameInt(meta.rdev, other.rdev) {
+		return false
+	}
+	if len(meta.xattrs) != len(other.xattrs) {
+		return false
+	}
+	for name, value := range meta.xattrs {
+		otherValue, ok := other.xattrs[name]
+		if !ok || !bytes.Equal(value, otherValue) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameInt(a *int64, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// compare what's on disk now against the metadata of the current version of this path, without writing anything
+// changed means something other than mtime changed, meaning there should be a new version
+// stale means the saved metadata should just be updated in place (see updateMetadata)
+func compareMetadata(path string, meta fileMetadata, tx *sql.Tx) (changed bool, stale bool) {
+	old := loadMetadata(path, currentStart(path, tx), tx)
+	if old == nil {
+		// backed up before metadata was saved at all
+		return false, true
+	}
+	if !old.sameAs(meta) {
+		log.Println("METADATA CHANGED:", path, "mode was", old.mode, "and is now", meta.mode)
+		return true, false
+	}
+	return false, old.mtimeNs != meta.mtimeNs
+}
+
+// an mtime change by itself just gets written over the current version, the same way fs_modified does, since the contents are the same
+// and a version from before metadata was saved gets it filled in
+func updateMetadata(path string, meta fileMetadata, tx *sql.Tx) {
+	start := currentStart(path, tx)
+	if loadMetadata(path, start, tx) == nil {
+		saveMetadata(path, start, meta, tx)
+		return
+	}
+	_, err := tx.Exec("UPDATE metadata SET mtime_ns = ? WHERE path = ? AND start = ?", meta.mtimeNs, path, start)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// compareMetadata then updateMetadata if needed, returns whether there should be a new version
+func metadataChanged(path string, meta fileMetadata, tx *sql.Tx) bool {
+	changed, stale := compareMetadata(path, meta, tx)
+	if stale {
+		updateMetadata(path, meta, tx)
+	}
+	return changed
+}
+
+func currentStart(path string, tx *sql.Tx) int64 {
+	var start int64
+	err := tx.QueryRow("SELECT start FROM files WHERE path = ? AND end IS NULL", path).Scan(&start)
+	if err != nil {
+		panic(err)
+	}
+	return start
+}
+
+func saveMetadata(path string, start int64, meta fileMetadata, tx *sql.Tx) {
+	_, err := tx.Exec("INSERT INTO metadata (path, start, mode, uid, gid, mtime_ns, rdev) VALUES (?, ?, ?, ?, ?, ?, ?)", path, start, uint32(meta.mode), meta.uid, meta.gid, meta.mtimeNs, meta.rdev)
+	if err != nil {
+		panic(err)
+	}
+	for name, value := range meta.xattrs {
+		_, err = tx.Exec("INSERT INTO xattrs (path, start, name, value) VALUES (?, ?, ?, ?)", path, start, name, value)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// nil if this version was backed up before metadata was saved
+func loadMetadata(path string, start int64, tx *sql.Tx) *fileMetadata {
+	var meta fileMetadata
+	var mode uint32
+	err := tx.QueryRow("SELECT mode, uid, gid, mtime_ns, rdev FROM metadata WHERE path = ? AND start = ?", path, start).Scan(&mode, &meta.uid, &meta.gid, &meta.mtimeNs, &meta.rdev)
+	if err == ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	meta.mode = os.FileMode(mode)
+	rows, err := tx.Query("SELECT name, value FROM xattrs WHERE path = ? AND start = ?", path, start)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var value []byte
+		err := rows.Scan(&name, &value)
+		if err != nil {
+			panic(err)
+		}
+		if meta.xattrs == nil {
+			meta.xattrs = make(map[string][]byte)
+		}
+		meta.xattrs[name] = value
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return &meta
+}
+
+// put the metadata back onto a restored file
+// none of this is fatal, e.g. setting the owner only works as root
+func applyMetadata(path string, meta *fileMetadata) {
+	if meta.uid != nil && meta.gid != nil {
+		if err := os.Lchown(path, int(*meta.uid), int(*meta.gid)); err != nil {
+			log.Println("Unable to set the owner of", path, "to", *meta.uid, *meta.gid, err)
+		}
+	}
+	if meta.mode&os.ModeSymlink != 0 {
+		return // everything else would follow the link and change whatever it points to instead
+	}
+	for name, value := range meta.xattrs {
+		if err := writeXattr(path, name, value); err != nil {
+			log.Println("Unable to set xattr", name, "on", path, err)
+		}
+	}
+	// after chown, since chown clears setuid and setgid
+	if err := os.Chmod(path, meta.mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		log.Println("Unable to set the permissions of", path, "to", meta.mode, err)
+	}
+	mtime := time.Unix(0, meta.mtimeNs)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		log.Println("Unable to set the modified time of", path, err)
+	}
+}
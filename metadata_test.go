@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		path := filepath.Join(src, "a")
+		err := ioutil.WriteFile(path, []byte("meme"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Unix(1500000000, 123456789)
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+		nextBackup()
+		upload(backupADirectoryRecursively(src))
+		if n := countRows(t, "SELECT COUNT(*) FROM files"); n != 1 {
+			t.Fatalf("nothing changed, but there are %d versions", n)
+		}
+
+		nextBackup()
+		err = os.Chmod(path, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+		if n := countRows(t, "SELECT COUNT(*) FROM files"); n != 2 {
+			t.Fatalf("chmod should make a new version, but there are %d versions", n)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM metadata"); n != 2 {
+			t.Fatalf("expected metadata for both versions, got %d", n)
+		}
+
+		// a new mtime with the same contents and mode is not a new version, it just updates the current one
+		nextBackup()
+		newMtime := time.Unix(1600000000, 987654321)
+		err = os.Chtimes(path, newMtime, newMtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+		if n := countRows(t, "SELECT COUNT(*) FROM files"); n != 2 {
+			t.Fatalf("an mtime change should not make a new version, but there are %d versions", n)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		versions := history(path, tx)
+		cases := []struct {
+			version historyEntry
+			mode    os.FileMode
+			mtime   time.Time
+		}{
+			{versions[0], 0644, mtime},
+			{versions[1], 0755, newMtime},
+		}
+		for i, c := range cases {
+			restored := filepath.Join(dest, "restored", string(rune('0'+i)))
+			if !restoreFile(c.version.hash, restored, loadMetadata(path, c.version.start, tx), tx) {
+				t.Fatalf("unable to restore version %d", i+1)
+			}
+			info, err := os.Stat(restored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != c.mode {
+				t.Errorf("version %d restored with mode %v instead of %v", i+1, info.Mode(), c.mode)
+			}
+			if !info.ModTime().Equal(c.mtime) {
+				t.Errorf("version %d restored with mtime %v instead of %v", i+1, info.ModTime(), c.mtime)
+			}
+		}
+	})
+}
+
+func TestMetadataSameAs(t *testing.T) {
+	one := int64(1)
+	two := int64(2)
+	a := fileMetadata{mode: 0644, uid: &one, gid: &one, mtimeNs: 5, xattrs: map[string][]byte{"user.a": []byte("x")}}
+	b := a
+	b.mtimeNs = 6
+	if !a.sameAs(b) {
+		t.Errorf("only mtime is different, should be the same")
+	}
+	b.uid = &two
+	if a.sameAs(b) {
+		t.Errorf("uid is different")
+	}
+	b = a
+	b.xattrs = map[string][]byte{"user.a": []byte("y")}
+	if a.sameAs(b) {
+		t.Errorf("xattr value is different")
+	}
+	b.xattrs = nil
+	if a.sameAs(b) {
+		t.Errorf("xattr is missing")
+	}
+}
+
+func countRows(t *testing.T, query string, args ...interface{}) int {
+	var n int
+	err := db.QueryRow(query, args...).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestStaleMetadataIsUpdatedByTheWriter(t *testing.T) {
+	WithTestingDatabase(t, func() {
+		src, err := ioutil.TempDir("", "gb-src-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(src)
+		path := filepath.Join(src, "a")
+		err = ioutil.WriteFile(path, []byte("meme"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Unix(1500000000, 100)
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backupADirectoryRecursively(src)
+
+		// like a version backed up before metadata was saved
+		_, err = db.Exec("DELETE FROM metadata")
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		toUp, res := checkFile(path, info, tx)
+		if toUp != nil || res == nil || !res.staleMetadata || res.needsHash() {
+			t.Fatalf("expected the writer to be asked to fill in the metadata, got %v %v", toUp, res)
+		}
+		if n := countRowsTx(t, tx, "SELECT COUNT(*) FROM metadata"); n != 0 {
+			t.Errorf("checking shouldn't write anything, but there are %d metadata rows", n)
+		}
+		tx.Commit()
+		nextBackup()
+		backupADirectoryRecursively(src)
+		if n := countRows(t, "SELECT COUNT(*) FROM metadata WHERE mtime_ns = ?", mtime.UnixNano()); n != 1 {
+			t.Errorf("the metadata should have been filled in")
+		}
+
+		// same second, so fs_modified is the same, but the nanoseconds are different
+		nextBackup()
+		mtime = time.Unix(1500000000, 200)
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backupADirectoryRecursively(src)
+		if n := countRows(t, "SELECT COUNT(*) FROM metadata WHERE mtime_ns = ?", mtime.UnixNano()); n != 1 {
+			t.Errorf("the mtime should have been updated in place")
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM files"); n != 1 {
+			t.Errorf("neither of those should be a new version, but there are %d", n)
+		}
+	})
+}
+
+func countRowsTx(t *testing.T, tx *sql.Tx, query string, args ...interface{}) int {
+	var n int
+	err := tx.QueryRow(query, args...).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func statOwner(info os.FileInfo) (uid *int64, gid *int64, rdev *int64) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, nil, nil
+	}
+	u := int64(stat.Uid)
+	g := int64(stat.Gid)
+	if info.Mode()&os.ModeDevice != 0 {
+		r := int64(stat.Rdev)
+		rdev = &r
+	}
+	return &u, &g, rdev
+}
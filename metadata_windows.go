@@ -0,0 +1,10 @@
+package main
+
+import (
+	"os"
+)
+
+// windows doesn't have unix owners or device numbers
+func statOwner(info os.FileInfo) (uid *int64, gid *int64, rdev *int64) {
+	return nil, nil, nil
+}
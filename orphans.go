@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// an object on a storage that no blob_storage row knows about
+// e.g. from a crash partway through an upload, before its blob got committed
+type orphan struct {
+	storage Storage
+	label   string
+	path    string
+	size    int64
+}
+
+// every object on this storage (or on every storage, if label is empty) that the database doesn't know about
+// don't run this while a backup is uploading, since a blob that's been uploaded but not committed yet looks exactly like an orphan
+func findOrphans(label string) []orphan {
+	storages := storagesByLabel(label)
+	listings := make(map[string][]ListedBlob)
+	for storageLabel, storage := range storages {
+		log.Println("Listing everything on", storageLabel)
+		listings[storageLabel] = storage.List()
+	}
+	// read what the database knows about only after listing, so that a blob committed while listing doesn't look like an orphan
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		err = tx.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	orphans := make([]orphan, 0)
+	for storageLabel, storage := range storages {
+		known := knownPaths(storage.GetID(), tx)
+		for _, listed := range listings[storageLabel] {
+			if !known[listed.path] {
+				orphans = append(orphans, orphan{storage, storageLabel, listed.path, listed.size})
+			}
+		}
+		log.Println(storageLabel, "has", len(listings[storageLabel]), "objects, and the database knows about", len(known), "of them")
+	}
+	return orphans
+}
+
+// by label, just the one with this label if it's not empty
+func storagesByLabel(label string) map[string]Storage {
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		err = tx.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	storages := make(map[string]Storage)
+	if label != "" {
+		storages[label] = storageByLabel(label, tx)
+		return storages
+	}
+	rows, err := tx.Query("SELECT readable_label FROM storage")
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	labels := make([]string, 0)
+	for rows.Next() {
+		var label string
+		err := rows.Scan(&label)
+		if err != nil {
+			panic(err)
+		}
+		labels = append(labels, label)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	rows.Close() // done with this query before storageByLabel makes more
+	for _, label := range labels {
+		storages[label] = storageByLabel(label, tx)
+	}
+	return storages
+}
+
+func knownPaths(storageID []byte, tx *sql.Tx) map[string]bool {
+	rows, err := tx.Query("SELECT full_path FROM blob_storage WHERE storage_id = ?", storageID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	known := make(map[string]bool)
+	for rows.Next() {
+		var path string
+		err := rows.Scan(&path)
+		if err != nil {
+			panic(err)
+		}
+		known[path] = true
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return known
+}
+
+func showOrphans(orphans []orphan) int64 {
+	total := int64(0)
+	for _, o := range orphans {
+		fmt.Printf("%s\t%s\t%d bytes\n", o.label, o.path, o.size)
+		total += o.size
+	}
+	fmt.Println(len(orphans), "objects that the database doesn't know about, totaling", total, "bytes")
+	return total
+}
+
+func deleteOrphans(orphans []orphan) {
+	for _, o := range orphans {
+		o.storage.Delete(o.path)
+	}
+	log.Println("Deleted", len(orphans), "orphaned objects")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOrphans(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		err := ioutil.WriteFile(filepath.Join(src, "a"), []byte("aaa"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+		if orphans := findOrphans(""); len(orphans) != 0 {
+			t.Fatalf("nothing should be orphaned yet, got %v", orphans)
+		}
+
+		// like a blob that was uploaded, but then the backup crashed before committing it
+		leftover := filepath.Join(dest, "gb", formatPath(randBytes(32)))
+		err = os.MkdirAll(filepath.Dir(leftover), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(leftover, make([]byte, 5021), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		orphans := findOrphans("test disk")
+		if len(orphans) != 1 || orphans[0].size != 5021 || orphans[0].label != "test disk" {
+			t.Fatalf("expected just the leftover, got %v", orphans)
+		}
+		if filepath.Join(dest, orphans[0].path) != leftover {
+			t.Errorf("expected %s, got %s", leftover, orphans[0].path)
+		}
+
+		deleteOrphans(orphans)
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("the leftover should be gone, got %v", err)
+		}
+		if orphans := findOrphans(""); len(orphans) != 0 {
+			t.Errorf("nothing should be orphaned anymore, got %v", orphans)
+		}
+		testAll() // the real blob is still there
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"log"
+)
+
+// a blob that's mostly dead space, and the entries in it that something still needs
+type repackBlob struct {
+	blobID []byte
+	size   int64
+	live   int64
+}
+
+// rewrite the live entries of blobs that are less than threshold live into fresh blobs, then delete the old blobs
+// a blob with nothing live in it at all isn't touched, that's gc's job
+func repack(threshold float64, dryRun bool) {
+	blobs, blobPlans, storages := planRepack(threshold, dryRun)
+	if dryRun || len(blobs) == 0 {
+		return
+	}
+	executeAll(blobPlans, storages)
+	// the new blobs and the repointed entries are committed by now, so the old blobs are just garbage
+	// deleting them is a separate transaction so that if this fails partway, nothing is lost, it just leaves garbage for gc
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		log.Println("Committing to database")
+		err = tx.Commit()
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Done")
+	}()
+	retiring := make(map[string]bool)
+	for _, blob := range blobs {
+		retiring[string(blob.blobID)] = true
+	}
+	garbage := make([]garbageBlob, 0)
+	for _, blob := range findGarbageBlobs(tx) {
+		if retiring[string(blob.blobID)] {
+			garbage = append(garbage, blob)
+		}
+	}
+	log.Println("Retiring", len(garbage), "old blobs")
+	deleteBlobs(garbage, tx)
+	pruneOrphanedHashes(tx)
+}
+
+// returns the blobs to repack, and the new blobs to write their live entries into
+func planRepack(threshold float64, dryRun bool) ([]repackBlob, []BlobPlan, []Storage) {
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		err = tx.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	blobs := findRepackBlobs(threshold, tx)
+	total := int64(0)
+	reclaimed := int64(0)
+	for _, blob := range blobs {
+		total += blob.live
+		reclaimed += blob.size - blob.live
+		log.Println("Blob", hex.EncodeToString(blob.blobID), "has", blob.live, "live bytes out of", blob.size)
+	}
+	log.Println("There are", len(blobs), "blobs under", threshold, "live, repacking them would rewrite", total, "bytes and reclaim", reclaimed, "bytes")
+	if dryRun || len(blobs) == 0 {
+		return nil, nil, nil
+	}
+	storages := GetAll(tx)
+	if len(storages) == 0 {
+		panic("There's nowhere to upload to!")
+	}
+	plan := make([]ToUpload, 0)
+	for _, blob := range blobs {
+		plan = append(plan, liveEntries(blob.blobID, tx)...)
+	}
+	return blobs, bucket(plan), storages
+}
+
+func findRepackBlobs(threshold float64, tx *sql.Tx) []repackBlob {
+	rows, err := tx.Query(`
+		SELECT blobs.blob_id, blobs.size, COALESCE(SUM(blob_entries.final_size), 0)
+		FROM blobs
+			LEFT OUTER JOIN blob_entries ON blob_entries.blob_id = blobs.blob_id AND blob_entries.hash IN (` + liveHashes + `)
+		GROUP BY blobs.blob_id
+	`)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	blobs := make([]repackBlob, 0)
+	for rows.Next() {
+		var blob repackBlob
+		err := rows.Scan(&blob.blobID, &blob.size, &blob.live)
+		if err != nil {
+			panic(err)
+		}
+		// the padding at the end doesn't count against it, every blob has that
+		if blob.live > 0 && float64(blob.live) < threshold*float64(blob.size-blobPadding) {
+			blobs = append(blobs, blob)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return blobs
+}
+
+// the entries in this blob that something still needs, and where to read them from
+// a file on disk that still has these contents is preferred, otherwise it gets read back out of storage
+func liveEntries(blobID []byte, tx *sql.Tx) []ToUpload {
+	rows, err := tx.Query(`
+		SELECT blob_entries.hash, hashes.size
+		FROM blob_entries
+			INNER JOIN hashes ON hashes.hash = blob_entries.hash
+		WHERE blob_entries.blob_id = ? AND blob_entries.hash IN (`+liveHashes+`)
+	`, blobID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	toUps := make([]ToUpload, 0)
+	for rows.Next() {
+		toUp := ToUpload{repack: true}
+		err := rows.Scan(&toUp.hash, &toUp.size)
+		if err != nil {
+			panic(err)
+		}
+		toUps = append(toUps, toUp)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	rows.Close()
+	for i := range toUps {
+		toUps[i].options = append(localSources(toUps[i].hash, tx), UploadSource{fromStorage: true})
+	}
+	return toUps
+}
+
+func localSources(hash []byte, tx *sql.Tx) []UploadSource {
+	rows, err := tx.Query("SELECT path, fs_modified FROM files WHERE hash = ? AND end IS NULL", hash)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	sources := make([]UploadSource, 0)
+	for rows.Next() {
+		var source UploadSource
+		err := rows.Scan(&source.path, &source.fs_modified)
+		if err != nil {
+			panic(err)
+		}
+		sources = append(sources, source)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return sources
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRepack(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		files := map[string][]byte{
+			"big":   randBytes(100000),
+			"kept":  []byte("kept"),
+			"moved": []byte("moved"),
+		}
+		for name, data := range files {
+			err := ioutil.WriteFile(filepath.Join(src, name), data, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		upload(backupADirectoryRecursively(src))
+		var oldBlob []byte
+		var oldPath string
+		err := db.QueryRow("SELECT blob_id, full_path FROM blob_storage").Scan(&oldBlob, &oldPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// most of the blob is dead now
+		_, err = db.Exec("DELETE FROM files WHERE path = ?", filepath.Join(src, "big"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// and this one is different on disk than what was backed up, so it has to be read back out of storage
+		changed := time.Unix(1234567890, 0)
+		err = os.Chtimes(filepath.Join(src, "moved"), changed, changed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		repack(0.5, true)
+		if n := countRows(t, "SELECT COUNT(*) FROM blobs"); n != 1 {
+			t.Fatalf("a dry run shouldn't change anything, but there are %d blobs", n)
+		}
+		repack(0.5, false)
+
+		if _, err := os.Stat(filepath.Join(dest, oldPath)); !os.IsNotExist(err) {
+			t.Errorf("the old blob should be deleted from disk, got %v", err)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM blobs WHERE blob_id = ?", oldBlob); n != 0 {
+			t.Errorf("the old blob should be deleted from the database")
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM blobs"); n != 1 {
+			t.Fatalf("expected exactly one new blob, got %d", n)
+		}
+		var newBlob []byte
+		var newSize int64
+		err = db.QueryRow("SELECT blob_id, size FROM blobs").Scan(&newBlob, &newSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if newSize > 1000+blobPadding {
+			t.Errorf("the new blob should only have the small files in it, but it's %d bytes", newSize)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM blob_entries WHERE blob_id = ?", newBlob); n != 2 {
+			t.Errorf("expected both surviving entries to point at the new blob, got %d", n)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM blob_entries"); n != 2 {
+			t.Errorf("expected the dead entry to be gone, got %d entries", n)
+		}
+		testAll()
+
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		var hash []byte
+		err = tx.QueryRow("SELECT hash FROM files WHERE path = ?", filepath.Join(src, "moved")).Scan(&hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(cat(hash, tx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, files["moved"]) {
+			t.Errorf("the entry read back out of storage came out as %q", data)
+		}
+	})
+}
+
+func TestRepackLeavesFullBlobsAlone(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		err := ioutil.WriteFile(filepath.Join(src, "a"), []byte("aaa"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		if blobs := findRepackBlobs(0.99, tx); len(blobs) != 0 {
+			t.Errorf("a blob that's entirely live (other than padding) shouldn't be repacked")
+		}
+	})
+}
+
+func TestRepackSkipsAnEntryThatCantBeRead(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		files := map[string][]byte{
+			"big":   randBytes(100000),
+			"kept":  []byte("kept"),
+			"moved": []byte("moved"),
+		}
+		for name, data := range files {
+			err := ioutil.WriteFile(filepath.Join(src, name), data, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		upload(backupADirectoryRecursively(src))
+		var oldBlob []byte
+		var oldPath string
+		err := db.QueryRow("SELECT blob_id, full_path FROM blob_storage").Scan(&oldBlob, &oldPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("DELETE FROM files WHERE path = ?", filepath.Join(src, "big"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the only copy of this one is in storage, and that's gone
+		err = os.Remove(filepath.Join(src, "moved"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Remove(filepath.Join(dest, oldPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			repack(0.5, false)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Minute):
+			t.Fatal("repack never finished")
+		}
+
+		var movedBlob []byte
+		err = db.QueryRow("SELECT blob_entries.blob_id FROM blob_entries INNER JOIN files ON files.hash = blob_entries.hash WHERE files.path = ?", filepath.Join(src, "moved")).Scan(&movedBlob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(movedBlob, oldBlob) {
+			t.Errorf("the entry that couldn't be read should have been left where it was")
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM blob_entries WHERE blob_id != ?", oldBlob); n != 1 {
+			t.Errorf("the entry that could be read should still have been repacked, got %d new entries", n)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+type storageWithLabel struct {
+	storage Storage
+	label   string
+}
+
+type blobToReplicate struct {
+	blobID      []byte
+	size        int64
+	hashPostEnc []byte
+}
+
+// copy every blob that isn't on this storage yet onto it
+// blobs are copied exactly as they are already stored (i.e. still encrypted), from whichever other storage has them
+// each blob is committed as soon as it's copied, so stopping partway through doesn't forget what was already copied
+func replicate(label string) {
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	dest := storageByLabel(label, tx)
+	blobs := blobsNotOn(dest.GetID(), tx)
+	err = tx.Commit()
+	if err != nil {
+		panic(err)
+	}
+	log.Println(len(blobs), "blobs need to be copied to", label)
+	for _, blob := range blobs {
+		tx, err := db.Begin()
+		if err != nil {
+			panic(err)
+		}
+		replicateBlob(blob, dest, tx)
+		err = tx.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}
+	log.Println("Done")
+}
+
+func storageByLabel(label string, tx *sql.Tx) Storage {
+	var storageID []byte
+	var kind string
+	var identifier string
+	var rootPath string
+	err := tx.QueryRow("SELECT storage_id, type, identifier, root_path FROM storage WHERE readable_label = ?", label).Scan(&storageID, &kind, &identifier, &rootPath)
+	if err == ErrNoRows {
+		usageError("No storage with label", label)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return StorageDataToStorage(storageID, kind, identifier, rootPath, tx)
+}
+
+func blobsNotOn(storageID []byte, tx *sql.Tx) []blobToReplicate {
+	rows, err := tx.Query(`
+		SELECT blob_id, size, hash_post_enc
+		FROM blobs
+		WHERE NOT EXISTS (
+			SELECT 1 FROM blob_storage WHERE blob_storage.blob_id = blobs.blob_id AND blob_storage.storage_id = ?
+		)
+	`, storageID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	blobs := make([]blobToReplicate, 0)
+	for rows.Next() {
+		var blob blobToReplicate
+		err := rows.Scan(&blob.blobID, &blob.size, &blob.hashPostEnc)
+		if err != nil {
+			panic(err)
+		}
+		blobs = append(blobs, blob)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return blobs
+}
+
+// every storage that has this blob, in the order we would prefer to read from them
+func blobLocations(blobID []byte, tx *sql.Tx) []storageWithLabel {
+	rows, err := tx.Query(`
+		SELECT storage.storage_id, storage.readable_label, storage.type, storage.identifier, storage.root_path
+		FROM blob_storage
+			INNER JOIN storage ON storage.storage_id = blob_storage.storage_id
+		WHERE blob_storage.blob_id = ?
+	`, blobID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	type locationData struct {
+		storageID  []byte
+		label      string
+		kind       string
+		identifier string
+		rootPath   string
+	}
+	datas := make([]locationData, 0)
+	for rows.Next() {
+		var data locationData
+		err := rows.Scan(&data.storageID, &data.label, &data.kind, &data.identifier, &data.rootPath)
+		if err != nil {
+			panic(err)
+		}
+		datas = append(datas, data)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	rows.Close()
+	sort.SliceStable(datas, func(i, j int) bool {
+		return storagePreference(datas[i].label, datas[i].kind) < storagePreference(datas[j].label, datas[j].kind)
+	})
+	locations := make([]storageWithLabel, 0)
+	for _, data := range datas {
+		locations = append(locations, storageWithLabel{StorageDataToStorage(data.storageID, data.kind, data.identifier, data.rootPath, tx), data.label})
+	}
+	return locations
+}
+
+func replicateBlob(blob blobToReplicate, dest Storage, tx *sql.Tx) {
+	log.Println("Replicating blob", hex.EncodeToString(blob.blobID), "with size", blob.size)
+	for _, source := range blobLocations(blob.blobID, tx) {
+		completed, err := copyBlob(blob, source.storage, dest)
+		if err != nil {
+			log.Println("Unable to copy from", source.label, "because", err, "so trying the next one")
+			continue
+		}
+		log.Println("Copied from", source.label)
+		_, err = tx.Exec("INSERT INTO blob_storage (blob_id, storage_id, full_path, checksum, timestamp) VALUES (?, ?, ?, ?, ?)", blob.blobID, dest.GetID(), completed.path, completed.checksum, time.Now().Unix())
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+	log.Println("Unable to replicate blob", hex.EncodeToString(blob.blobID), "from anywhere! Skipping it")
+}
+
+// a copy that fails partway is aborted, so nothing is left at the path on dest
+func copyBlob(blob blobToReplicate, source Storage, dest Storage) (completed CompletedUpload, err error) {
+	var upload StorageUpload
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+			if upload != nil {
+				upload.Abort()
+			}
+		}
+	}()
+	// the source first, since it's the one that's likely to not be there (unplugged drive, missing key, etc)
+	reader := source.DownloadSection(blob.blobID, 0, blob.size)
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	upload = dest.BeginBlobUpload(blob.blobID)
+	h := NewSHA256HasherSizer()
+	_, err = io.Copy(io.MultiWriter(upload.Begin(), &h), reader)
+	if err == nil {
+		// check before ending the upload, so that a bad copy never ends up at the real path
+		realHash, realSize := h.HashAndSize()
+		if realSize != blob.size {
+			err = fmt.Errorf("size was %d but expected %d", realSize, blob.size)
+		} else if !bytes.Equal(realHash, blob.hashPostEnc) {
+			err = fmt.Errorf("hash was %s but expected %s", hex.EncodeToString(realHash), hex.EncodeToString(blob.hashPostEnc))
+		}
+	}
+	if err != nil {
+		upload.Abort()
+		upload = nil
+		return CompletedUpload{}, err
+	}
+	ending := upload
+	upload = nil // once End has been called there's nothing to abort anymore, even if it panics
+	return ending.End(), nil
+}
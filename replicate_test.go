@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplicate(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		err := ioutil.WriteFile(filepath.Join(src, "a"), []byte("meme"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+
+		second, err := ioutil.TempDir("", "gb-second-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(second)
+		addStorage("second", "Disk", second, "gb/", nil)
+		replicate("second")
+		if n := countRows(t, "SELECT COUNT(*) FROM blob_storage"); n != 2 {
+			t.Fatalf("expected the blob on both storages, got %d", n)
+		}
+		os.RemoveAll(dest) // only the copy is left
+		testAll()
+
+		// now there's no readable source at all, so replicating has to fail cleanly
+		third, err := ioutil.TempDir("", "gb-third-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(third)
+		addStorage("third", "Disk", third, "gb/", nil)
+		os.RemoveAll(second)
+		replicate("third")
+		if n := countRows(t, "SELECT COUNT(*) FROM blob_storage"); n != 2 {
+			t.Fatalf("a failed copy should not be recorded, but there are %d rows", n)
+		}
+		filepath.Walk(third, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				t.Errorf("a failed copy left %s behind", path)
+			}
+			return nil
+		})
+	})
+}
+
+func TestCopyBlobAbortsBadCopy(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		err := ioutil.WriteFile(filepath.Join(src, "a"), []byte("meme"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+		var blob blobToReplicate
+		err = db.QueryRow("SELECT blob_id, size, hash_post_enc FROM blobs").Scan(&blob.blobID, &blob.size, &blob.hashPostEnc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob.hashPostEnc = make([]byte, 32) // wrong on purpose
+		other, err := ioutil.TempDir("", "gb-other-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(other)
+		source := &Disk{identifier: dest, rootPath: "gb/"}
+		target := &Disk{identifier: other, rootPath: "gb/"}
+		_, err = copyBlob(blob, source, target)
+		if err == nil || !strings.Contains(err.Error(), "hash was") {
+			t.Fatalf("expected a hash mismatch, got %v", err)
+		}
+		filepath.Walk(other, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				t.Errorf("a bad copy left %s behind", path)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// a file as of some point in time
+type fileVersion struct {
+	path  string
+	hash  []byte
+	size  int64
+	start int64
+}
+
+// restore everything that existed under this path at this time, into the folder "to"
+// returns how many files could not be restored
+func restore(path string, at int64, to string) int {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		panic(err)
+	}
+	to, err = filepath.Abs(to)
+	if err != nil {
+		panic(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		err = tx.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	files := filesAt(path, at, tx)
+	if len(files) == 0 {
+		log.Println("Nothing was backed up under", path, "at that time")
+		return 0
+	}
+	log.Println("Restoring", len(files), "files to", to)
+	failures := 0
+	for _, file := range files {
+		var rel string
+		if file.path == path {
+			rel = filepath.Base(path) // restoring a single file
+		} else {
+			rel = strings.TrimPrefix(file.path, strings.TrimSuffix(path, "/")+"/")
+		}
+		if !restoreFile(file.hash, filepath.Join(to, rel), loadMetadata(file.path, file.start, tx), tx) {
+			failures++
+		}
+	}
+	log.Println("Restored", len(files)-failures, "files,", failures, "failed")
+	return failures
+}
+
+// every file that was live at this timestamp, that is either this exact path, or inside this folder
+func filesAt(path string, at int64, tx *sql.Tx) []fileVersion {
+	dir := strings.TrimSuffix(path, "/") + "/"
+	rows, err := tx.Query(`
+		SELECT files.path, files.hash, hashes.size, files.start
+		FROM files
+			INNER JOIN hashes ON hashes.hash = files.hash
+		WHERE (files.path = ? OR files.path GLOB ?) AND files.start <= ? AND (files.end IS NULL OR files.end > ?)
+		ORDER BY files.path
+	`, path, dir+"*", at, at)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	files := make([]fileVersion, 0)
+	for rows.Next() {
+		var file fileVersion
+		err := rows.Scan(&file.path, &file.hash, &file.size, &file.start)
+		if err != nil {
+			panic(err)
+		}
+		if file.path != path && !strings.HasPrefix(file.path, dir) {
+			continue // a * in the folder name, see pruneDeletedFiles
+		}
+		files = append(files, file)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return files
+}
+
+// download this hash to this path, only putting it in place once the hash has been checked
+// meta can be nil, for a version that was backed up before metadata was saved
+func restoreFile(hash []byte, dest string, meta *fileMetadata, tx *sql.Tx) bool {
+	if _, err := os.Lstat(dest); err == nil {
+		log.Println(dest, "already exists, not overwriting it")
+		return false
+	}
+	if meta != nil && meta.mode&os.ModeSymlink != 0 {
+		return restoreSymlink(hash, dest, meta, tx)
+	}
+	if meta != nil && isSpecial(meta.mode) {
+		return restoreSpecial(dest, meta)
+	}
+	log.Println("Restoring", dest)
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		log.Println("Unable to create folder for", dest, err)
+		return false
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".gb-restore-")
+	if err != nil {
+		log.Println("Unable to create temp file for", dest, err)
+		return false
+	}
+	h := NewSHA256HasherSizer()
+	err = tryCat(hash, io.MultiWriter(tmp, &h), tx)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		log.Println("Unable to write", dest, err)
+		os.Remove(tmp.Name())
+		return false
+	}
+	realHash, _ := h.HashAndSize()
+	if !bytes.Equal(realHash, hash) {
+		log.Println("Downloaded", dest, "but its hash was", hex.EncodeToString(realHash), "instead of", hex.EncodeToString(hash))
+		os.Remove(tmp.Name())
+		return false
+	}
+	if meta != nil {
+		applyMetadata(tmp.Name(), meta)
+	}
+	err = os.Rename(tmp.Name(), dest)
+	if err != nil {
+		log.Println("Unable to move", dest, "into place", err)
+		os.Remove(tmp.Name())
+		return false
+	}
+	return true
+}
+
+// the contents of a symlink are where it points
+func restoreSymlink(hash []byte, dest string, meta *fileMetadata, tx *sql.Tx) bool {
+	var target bytes.Buffer
+	err := tryCat(hash, &target, tx)
+	if err != nil {
+		log.Println("Unable to get where", dest, "should point", err)
+		return false
+	}
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		log.Println("Unable to create folder for", dest, err)
+		return false
+	}
+	err = os.Symlink(target.String(), dest)
+	if err != nil {
+		log.Println("Unable to create symlink", dest, err)
+		return false
+	}
+	applyMetadata(dest, meta)
+	return true
+}
+
+// a fifo or a device is made from just its metadata
+func restoreSpecial(dest string, meta *fileMetadata) bool {
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		log.Println("Unable to create folder for", dest, err)
+		return false
+	}
+	err = makeSpecial(dest, meta)
+	if err != nil {
+		log.Println("Unable to create", dest, "which is a", meta.mode, err) // devices can only be made by root
+		return false
+	}
+	applyMetadata(dest, meta)
+	return true
+}
+
+// cat panics if this was never uploaded, or no storage can give it back, but when restoring that's just this one file failing
+func tryCat(hash []byte, out io.Writer, tx *sql.Tx) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	_, err = io.Copy(out, cat(hash, tx))
+	return err
+}
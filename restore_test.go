@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestore(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		err := os.MkdirAll(filepath.Join(src, "sub"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(src, "a"), []byte("aaa"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(src, "sub", "b"), []byte("bbb"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+		uploaded := now
+
+		// scanned but never uploaded, so it can't be restored
+		nextBackup()
+		err = ioutil.WriteFile(filepath.Join(src, "c"), []byte("ccc"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backupADirectoryRecursively(src)
+
+		to := filepath.Join(dest, "restored")
+		if failures := restore(src, now, to); failures != 1 {
+			t.Fatalf("expected only c to fail, got %d failures", failures)
+		}
+		for name, contents := range map[string]string{"a": "aaa", "sub/b": "bbb"} {
+			data, err := ioutil.ReadFile(filepath.Join(to, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != contents {
+				t.Errorf("%s was restored as %q", name, data)
+			}
+		}
+		filepath.Walk(to, func(path string, info os.FileInfo, err error) error {
+			if err == nil && strings.HasPrefix(info.Name(), ".gb-restore-") {
+				t.Errorf("temp file %s was left behind", path)
+			}
+			return nil
+		})
+		if _, err := os.Stat(filepath.Join(to, "c")); !os.IsNotExist(err) {
+			t.Errorf("c should not have been restored")
+		}
+
+		// as of before c existed, everything is there
+		if failures := restore(src, uploaded, filepath.Join(dest, "before")); failures != 0 {
+			t.Errorf("expected no failures, got %d", failures)
+		}
+		if _, err := os.Stat(filepath.Join(dest, "before", "c")); !os.IsNotExist(err) {
+			t.Errorf("c didn't exist yet")
+		}
+	})
+}
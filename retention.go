@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/leijurv/gb/config"
+)
+
+const day = 24 * 60 * 60
+
+type expiredVersion struct {
+	path   string
+	start  int64
+	reason string
+}
+
+// delete files rows that are too old to keep according to the retention config, then hashes that nothing refers to anymore
+// this doesn't delete anything from storage, that's what gc is for (after this)
+func expire(dryRun bool) {
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		log.Println("Committing to database")
+		err = tx.Commit()
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Done")
+	}()
+	expired := findExpiredVersions(config.Config().Retention, time.Now().Unix(), tx)
+	for _, version := range expired {
+		if dryRun {
+			log.Println("Would drop", version.path, "version from", formatTimestamp(version.start), "because", version.reason)
+			continue
+		}
+		log.Println("Dropping", version.path, "version from", formatTimestamp(version.start), "because", version.reason)
+		_, err = tx.Exec("DELETE FROM files WHERE path = ? AND start = ?", version.path, version.start)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if dryRun {
+		log.Println("Would drop", len(expired), "versions")
+		return
+	}
+	log.Println("Dropped", len(expired), "versions")
+	pruneOrphanedHashes(tx)
+}
+
+func findExpiredVersions(retention config.Retention, now int64, tx *sql.Tx) []expiredVersion {
+	rows, err := tx.Query(`
+		SELECT files.path, files.start, files.end, EXISTS(SELECT 1 FROM excluded WHERE excluded.path = files.path AND excluded.start = files.start)
+		FROM files
+		ORDER BY files.path, files.start
+	`)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	expired := make([]expiredVersion, 0)
+	var path string
+	var versions []fileVersionTimes
+	for rows.Next() {
+		var version fileVersionTimes
+		var versionPath string
+		err := rows.Scan(&versionPath, &version.start, &version.end, &version.excluded)
+		if err != nil {
+			panic(err)
+		}
+		if versionPath != path && versions != nil {
+			expired = append(expired, expireOneFile(path, versions, retention, now)...)
+			versions = nil
+		}
+		path = versionPath
+		versions = append(versions, version)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	if versions != nil {
+		expired = append(expired, expireOneFile(path, versions, retention, now)...)
+	}
+	return expired
+}
+
+type fileVersionTimes struct {
+	start    int64
+	end      *int64
+	excluded bool // ended because it was excluded, not because it was deleted
+}
+
+// versions are in order of start
+func expireOneFile(path string, versions []fileVersionTimes, retention config.Retention, now int64) []expiredVersion {
+	expired := make([]expiredVersion, 0)
+	latest := versions[len(versions)-1]
+	keepDays, how := retention.KeepDeletedDays, "deleted"
+	if latest.excluded {
+		keepDays, how = retention.KeepExcludedDays, "excluded"
+	}
+	if latest.end != nil && now-*latest.end > keepDays*day {
+		// deleted (or excluded) long enough ago that we forget about it entirely
+		for _, version := range versions {
+			expired = append(expired, expiredVersion{path, version.start, "the file was " + how + " over " + strconv.FormatInt(keepDays, 10) + " days ago"})
+		}
+		return expired
+	}
+	allUntil := retention.KeepAllDays * day
+	dailyUntil := allUntil + retention.KeepDailyDays*day
+	weeklyUntil := dailyUntil + retention.KeepWeeklyDays*day
+	monthlyUntil := weeklyUntil + retention.KeepMonthlyDays*day
+	type bucket struct {
+		tier string
+		n    int64
+	}
+	kept := make(map[bucket]bool) // which day, week, or month already has a version in it
+	// newest first, so that the version kept in each bucket is the last one of that day / week / month
+	for i := len(versions) - 1; i >= 0; i-- {
+		version := versions[i]
+		if version.end == nil || i == len(versions)-1 {
+			continue // the current version, or the last version of a deleted file, is always kept
+		}
+		age := now - *version.end
+		var b bucket
+		switch {
+		case age <= allUntil:
+			continue
+		case age <= dailyUntil:
+			b = bucket{"day", *version.end / day}
+		case age <= weeklyUntil:
+			b = bucket{"week", *version.end / (7 * day)}
+		case age <= monthlyUntil:
+			t := time.Unix(*version.end, 0)
+			b = bucket{"month", int64(t.Year())*12 + int64(t.Month())}
+		default:
+			expired = append(expired, expiredVersion{path, version.start, "it's older than every retention tier"})
+			continue
+		}
+		if kept[b] {
+			expired = append(expired, expiredVersion{path, version.start, "a newer version from the same " + b.tier + " is being kept"})
+			continue
+		}
+		kept[b] = true
+	}
+	return expired
+}
+
+// hashes that nothing refers to anymore
+// hashes still used by blob_entries stay until gc gets rid of the blob entry
+func pruneOrphanedHashes(tx *sql.Tx) {
+	result, err := tx.Exec(`
+		DELETE FROM hashes
+		WHERE
+			hash NOT IN (SELECT hash FROM files) AND
+			hash NOT IN (SELECT hash FROM blob_entries) AND
+			hash NOT IN (SELECT hash FROM file_chunks) AND
+			hash NOT IN (SELECT chunk_hash FROM file_chunks)
+	`)
+	if err != nil {
+		panic(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	log.Println("Deleted", n, "hashes that nothing refers to anymore")
+}
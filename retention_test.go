@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/leijurv/gb/config"
+)
+
+func TestExpireOneFile(t *testing.T) {
+	retention := config.Retention{
+		KeepAllDays:      1,
+		KeepDailyDays:    2,
+		KeepWeeklyDays:   0,
+		KeepMonthlyDays:  0,
+		KeepDeletedDays:  10,
+		KeepExcludedDays: 30,
+	}
+	now := int64(100 * day)
+	end := func(daysAgo float64) *int64 {
+		t := now - int64(daysAgo*day)
+		return &t
+	}
+	versions := []fileVersionTimes{
+		{1, end(5), false},    // too old for any tier
+		{2, end(2.1), false},  // daily tier, but 3 is newer on the same day
+		{3, end(2.05), false}, // daily tier, kept
+		{4, end(0.5), false},  // keep all tier
+		{5, end(0.4), false},  // keep all tier
+		{6, nil, false},       // current
+	}
+	expired := expireOneFile("/a", versions, retention, now)
+	if len(expired) != 2 || expired[0].start != 2 || expired[1].start != 1 {
+		t.Errorf("wrong versions expired: %v", expired)
+	}
+
+	deleted := []fileVersionTimes{
+		{1, end(20), false},
+		{2, end(11), false},
+	}
+	if len(expireOneFile("/b", deleted, retention, now)) != 2 {
+		t.Errorf("file deleted 11 days ago should be forgotten entirely")
+	}
+	deleted[1].end = end(9)
+	expired = expireOneFile("/b", deleted, retention, now)
+	if len(expired) != 1 || expired[0].start != 1 {
+		t.Errorf("last version of a recently deleted file should be kept: %v", expired)
+	}
+
+	excluded := []fileVersionTimes{
+		{1, end(20), false},
+		{2, end(11), true},
+	}
+	expired = expireOneFile("/c", excluded, retention, now)
+	if len(expired) != 1 || expired[0].start != 1 {
+		t.Errorf("a file excluded 11 days ago is kept for keep_excluded_days, not keep_deleted_days: %v", expired)
+	}
+	excluded[1].end = end(31)
+	if len(expireOneFile("/c", excluded, retention, now)) != 2 {
+		t.Errorf("file excluded 31 days ago should be forgotten entirely")
+	}
+}
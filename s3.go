@@ -2,11 +2,14 @@ package main
 
 import (
 	"crypto/md5"
+	"database/sql"
 	"encoding/hex"
+	"errors"
 	"io"
 	"log"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -14,14 +17,27 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
-var AWSSession = session.Must(session.NewSession(&aws.Config{Region: aws.String("us-west-1")}))
-
 const s3PartSize = 5 * 1024 * 1024
 
+// what storages created before s3_options existed were using
+const defaultS3Region = "us-west-1"
+
+var s3Sessions = make(map[string]*session.Session)
+var s3SessionsLock sync.Mutex
+
 type S3 struct {
 	storageID []byte
 	bucket    string
 	rootPath  string
+	options   S3Options
+}
+
+// how to talk to this particular bucket, so that every storage can be a different account, region, or provider entirely
+type S3Options struct {
+	endpoint  *string
+	region    string
+	pathStyle bool
+	profile   *string
 }
 
 type s3Result struct {
@@ -54,6 +70,44 @@ func (remote *S3) niceRootPath() string {
 	return path
 }
 
+func loadS3Options(storageID []byte, tx *sql.Tx) S3Options {
+	options := S3Options{region: defaultS3Region}
+	err := tx.QueryRow("SELECT endpoint, region, path_style, profile FROM s3_options WHERE storage_id = ?", storageID).Scan(&options.endpoint, &options.region, &options.pathStyle, &options.profile)
+	if err != nil && err != ErrNoRows {
+		panic(err)
+	}
+	return options
+}
+
+func saveS3Options(storageID []byte, options S3Options, tx *sql.Tx) {
+	_, err := tx.Exec("INSERT OR REPLACE INTO s3_options (storage_id, endpoint, region, path_style, profile) VALUES (?, ?, ?, ?, ?)", storageID, options.endpoint, options.region, options.pathStyle, options.profile)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// sessions are somewhat expensive to make (they read ~/.aws every time), so only make one per storage
+func (remote *S3) session() *session.Session {
+	s3SessionsLock.Lock()
+	defer s3SessionsLock.Unlock()
+	key := string(remote.storageID)
+	sess, ok := s3Sessions[key]
+	if !ok {
+		config := aws.Config{
+			Region:           aws.String(remote.options.region),
+			Endpoint:         remote.options.endpoint,
+			S3ForcePathStyle: aws.Bool(remote.options.pathStyle),
+		}
+		opts := session.Options{Config: config}
+		if remote.options.profile != nil {
+			opts.Profile = *remote.options.profile
+		}
+		sess = session.Must(session.NewSessionWithOptions(opts))
+		s3Sessions[key] = sess
+	}
+	return sess
+}
+
 func formatPath(blobID []byte) string {
 	if len(blobID) != 32 {
 		panic(len(blobID))
@@ -66,7 +120,7 @@ func (remote *S3) BeginBlobUpload(blobID []byte) StorageUpload {
 	path := remote.niceRootPath() + formatPath(blobID)
 	log.Println("Path is", path)
 	pipeR, pipeW := io.Pipe()
-	uploader := s3manager.NewUploader(AWSSession, func(u *s3manager.Uploader) {
+	uploader := s3manager.NewUploader(remote.session(), func(u *s3manager.Uploader) {
 		u.PartSize = s3PartSize
 	})
 	resultCh := make(chan s3Result)
@@ -96,7 +150,7 @@ func (remote *S3) DownloadSection(blobID []byte, offset int64, length int64) io.
 	log.Println("S3 key is", path)
 	rangeStr := "bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+length-1, 10)
 	log.Println("S3 range is", rangeStr)
-	result, err := s3.New(AWSSession).GetObject(&s3.GetObjectInput{
+	result, err := s3.New(remote.session()).GetObject(&s3.GetObjectInput{
 		Bucket: aws.String(remote.bucket),
 		Key:    aws.String(path),
 		Range:  aws.String(rangeStr),
@@ -107,6 +161,35 @@ func (remote *S3) DownloadSection(blobID []byte, offset int64, length int64) io.
 	return result.Body
 }
 
+func (remote *S3) Delete(path string) {
+	log.Println("Deleting", path, "from S3")
+	_, err := s3.New(remote.session()).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(remote.bucket),
+		Key:    aws.String(path),
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (remote *S3) List() []ListedBlob {
+	blobs := make([]ListedBlob, 0)
+	err := s3.New(remote.session()).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(remote.bucket),
+		Prefix: aws.String(remote.niceRootPath()),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			blobs = append(blobs, ListedBlob{*obj.Key, *obj.Size})
+		}
+		log.Println("Listed", len(blobs), "objects so far")
+		return true
+	})
+	if err != nil {
+		panic(err)
+	}
+	return blobs
+}
+
 func (up *s3Upload) Begin() io.Writer {
 	return io.MultiWriter(up.calc.writer, up.writer)
 }
@@ -121,7 +204,7 @@ func (up *s3Upload) End() CompletedUpload {
 	log.Println("Upload output", result.result.Location)
 	etag := <-up.calc.result
 	log.Println("Expecting etag", etag)
-	real := checkETag(up.s3.bucket, up.path)
+	real := up.s3.checkETag(up.path)
 	log.Println("Real etag was", real)
 	if etag != real {
 		panic("aws broke the etag lmao")
@@ -132,9 +215,17 @@ func (up *s3Upload) End() CompletedUpload {
 	}
 }
 
-func checkETag(bucket string, path string) string {
-	result, err := s3.New(AWSSession).HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(bucket),
+func (up *s3Upload) Abort() {
+	// s3manager aborts the multipart upload itself when reading the body fails
+	up.writer.CloseWithError(errors.New("upload aborted"))
+	up.calc.writer.Close()
+	<-up.result
+	<-up.calc.result
+}
+
+func (remote *S3) checkETag(path string) string {
+	result, err := s3.New(remote.session()).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(remote.bucket),
 		Key:    aws.String(path),
 	})
 	if err != nil {
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestS3OptionsRoundTrip(t *testing.T) {
+	WithTestingDatabase(t, func() {
+		endpoint := "http://localhost:9000"
+		profile := "minio"
+		addStorage("minio", "S3", "bucket", "gb/", &S3Options{
+			endpoint:  &endpoint,
+			region:    "us-east-1",
+			pathStyle: true,
+			profile:   &profile,
+		})
+		// from before s3_options existed
+		_, err := db.Exec("INSERT INTO storage (storage_id, readable_label, type, identifier, root_path) VALUES (?, ?, ?, ?, ?)", randBytes(32), "old", "S3", "other-bucket", "gb/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		storages := GetAll(tx)
+		if len(storages) != 2 {
+			t.Fatalf("expected 2 storages, got %d", len(storages))
+		}
+		for _, storage := range storages {
+			remote := storage.(*S3)
+			switch remote.bucket {
+			case "bucket":
+				o := remote.options
+				if o.endpoint == nil || *o.endpoint != endpoint || o.region != "us-east-1" || !o.pathStyle || o.profile == nil || *o.profile != profile {
+					t.Errorf("options didn't round trip: %+v", o)
+				}
+			case "other-bucket":
+				o := remote.options
+				if o.endpoint != nil || o.region != defaultS3Region || o.pathStyle || o.profile != nil {
+					t.Errorf("a storage without options should get the defaults: %+v", o)
+				}
+			default:
+				t.Errorf("unexpected bucket %s", remote.bucket)
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// removing the storage takes its options with it
+		removeStorage("minio")
+		if n := countRows(t, "SELECT COUNT(*) FROM s3_options"); n != 0 {
+			t.Errorf("expected the options to be deleted along with the storage, %d are left", n)
+		}
+	})
+}
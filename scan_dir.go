@@ -6,12 +6,24 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/leijurv/gb/config"
 )
 
 var now = time.Now().Unix() // all files whose contents are set during this backup are set to the same "now", explanation is in the spec
 
-func backupADirectoryRecursively(path string) {
+// everything that couldn't be read during this run, so that backup can complain about it at the end instead of giving up at the first one
+var scanErrors = make([]scanError, 0)
+
+type scanError struct {
+	path string
+	err  error
+}
+
+// returns the files that should be hashed during upload instead of now, see checkFile
+func backupADirectoryRecursively(path string) []ToUpload {
 	log.Println("Going to back up this folder:", path)
 	var err error
 	path, err = filepath.Abs(path)
@@ -22,11 +34,11 @@ func backupADirectoryRecursively(path string) {
 	stat, err := os.Stat(path)
 	if err != nil {
 		log.Println("Path doesn't exist rart")
-		return
+		return nil
 	}
 	if !stat.IsDir() {
 		log.Println("This is not a directory btw wtf single files are rart and i wont deal with them owned")
-		return
+		return nil
 	}
 	log.Println("Good this is a directory")
 	if !strings.HasSuffix(path, "/") {
@@ -47,36 +59,152 @@ func backupADirectoryRecursively(path string) {
 		log.Println("Done")
 	}()
 	filesMap := make(map[string]os.FileInfo)
+	ignorer := NewIgnorer()
+	failed := make([]string, 0) // files and folders (with a trailing slash) that couldn't be read, so we don't know what's in them now
+	hashLater := make([]ToUpload, 0)
+
+	// the walk decides what needs hashing, a pool of workers hashes, and one writer puts the results in the database
+	// only the writer writes to tx, and only the writer touches failed and scanErrors
+	workers := hashWorkers(path)
+	log.Println("Hashing with", workers, "workers")
+	jobs := make(chan scanResult, workers)
+	results := make(chan scanResult, workers)
+	var hashing sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		hashing.Add(1)
+		go func() {
+			defer hashing.Done()
+			for res := range jobs {
+				if res.needsHash() {
+					hashFile(&res)
+				}
+				results <- res
+			}
+		}()
+	}
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for res := range results {
+			failed = saveScanResult(res, failed, tx)
+		}
+	}()
+
 	log.Println("Beginning scan now!")
-	err = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+	root := path
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
+			isDir := info != nil && info.IsDir()
+			if path != root && ignorer.ignored(path, isDir) {
+				// it doesn't matter that it can't be read, since it's not supposed to be backed up anyway
+				ignorer.exclude(path, isDir)
+				if isDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
 			log.Println("While traversing those files, I got this error:")
 			log.Println(err)
 			log.Println("while looking at this path:")
 			log.Println(path)
-			return err
+			jobs <- scanResult{path: path, err: err, dir: isDir}
+			if isDir {
+				return filepath.SkipDir
+			}
+			return nil
 		}
 		if info.IsDir() {
 			// we do not back up directories
+			// but we do skip the whole thing if it's excluded
+			if path != root && ignorer.ignored(path, true) {
+				ignorer.exclude(path, true)
+				return filepath.SkipDir
+			}
+			ignorer.loadDir(path)
+			return nil
+		}
+		if ignorer.ignored(path, false) {
+			ignorer.exclude(path, false)
+			return nil
+		}
+		if !canBackUp(info.Mode()) {
+			log.Println("Skipping", path, "since it's a", info.Mode(), "which can't be backed up")
 			return nil
 		}
 		filesMap[path] = info
-		backupOneFile(path, info, tx)
+		toUp, res := checkFile(path, info, tx)
+		if toUp != nil {
+			hashLater = append(hashLater, *toUp)
+		}
+		if res != nil {
+			jobs <- *res
+		}
 		return nil
 	})
+	close(jobs)
+	hashing.Wait()
+	close(results)
+	<-written
 	if err != nil {
-		// permission error while traversing
-		// we should *not* continue, because that would mark all further files as "deleted"
-		// aka, do not continue with a partially complete traversal of the directory lmao
-		panic(err)
+		panic(err) // the walk function never returns an error, so this can't happen
 	}
 	log.Println("Finally, handling deleted files!")
 	// anything that was in this directory but is no longer can be deleted
-	pruneDeletedFiles(path, filesMap, tx)
+	// except for what couldn't be read, since we don't know whether that's still there
+	pruneDeletedFiles(path, filesMap, ignorer, failed, tx)
+	return hashLater
+}
+
+// how many files to hash at once under this folder
+// the most specific setting in hash_workers_per_root wins, e.g. a spinning disk mounted at /mnt/hdd can be set to 1 since it'd only thrash
+func hashWorkers(root string) int {
+	workers := config.Config().HashWorkers
+	longest := -1
+	for prefix, n := range config.Config().HashWorkersPerRoot {
+		prefix = strings.TrimSuffix(prefix, "/") + "/"
+		if strings.HasPrefix(root, prefix) && len(prefix) > longest {
+			workers = n
+			longest = len(prefix)
+		}
+	}
+	if workers < 1 {
+		return 1
+	}
+	return workers
+}
+
+// applies what the walk and the hashing workers found out about one path, returns failed with this path added if it couldn't be read
+func saveScanResult(res scanResult, failed []string, tx *sql.Tx) []string {
+	if res.err == errChangedWhileReading {
+		// not worth failing the whole backup over, it'll probably be quieter next time
+		log.Println("WARNING:", res.path, "kept changing while I was reading it, so skipping it this time and leaving it as it was")
+		return append(failed, res.path)
+	}
+	if res.err != nil {
+		scanErrors = append(scanErrors, scanError{res.path, res.err})
+		if res.dir {
+			log.Println("Unable to read", res.path, "so skipping everything in it, and leaving what was backed up from in there as it was:", res.err)
+			return append(failed, strings.TrimSuffix(res.path, "/")+"/")
+		}
+		log.Println("Unable to read", res.path, "so leaving it as it was:", res.err)
+		return append(failed, res.path)
+	}
+	if res.staleMetadata {
+		updateMetadata(res.path, res.meta, tx)
+		return failed
+	}
+	if res.metadataOnly {
+		newVersion(res.path, res.hash, res.info.ModTime().Unix(), res.meta, tx)
+		return failed
+	}
+	saveFileHash(res.path, res.hash, res.size, res.info.ModTime().Unix(), res.meta, res.expectedHash, tx)
+	return failed
 }
 
 // find files in the database for this path, that no longer exist on disk (i.e. they're DELETED LOL)
-func pruneDeletedFiles(backupPath string, filesMap map[string]os.FileInfo, tx *sql.Tx) {
+// or that are excluded now. those end the same way, since they aren't being backed up anymore, but get remembered as excluded so that expire can tell them apart
+// anything in failed, or in a folder in failed, is left alone
+func pruneDeletedFiles(backupPath string, filesMap map[string]os.FileInfo, ignorer *Ignorer, failed []string, tx *sql.Tx) {
 	if !strings.HasSuffix(backupPath, "/") {
 		panic(backupPath) // sanity check, should have already been completed
 	}
@@ -96,8 +224,20 @@ func pruneDeletedFiles(backupPath string, filesMap map[string]os.FileInfo, tx *s
 			log.Println("Having a * in your folder name is really a bad idea, good thing I thought of this!")
 			continue
 		}
+		if underFailure(databasePath, failed) {
+			log.Println(databasePath, "couldn't be checked this time, so leaving it as it was")
+			continue
+		}
 		if _, ok := filesMap[databasePath]; !ok {
-			log.Println(databasePath, "used to exist but does not any longer. Marking as ended.")
+			if ignorer.wasExcluded(databasePath) {
+				log.Println(databasePath, "is excluded now, so it's deliberately no longer being backed up. Marking as ended.")
+				_, err = tx.Exec("INSERT INTO excluded (path, start) SELECT path, start FROM files WHERE path = ? AND end IS NULL", databasePath)
+				if err != nil {
+					panic(err)
+				}
+			} else {
+				log.Println(databasePath, "used to exist but does not any longer. Marking as ended.")
+			}
 			_, err = tx.Exec("UPDATE files SET end = ? WHERE path = ? AND end IS NULL", now, databasePath)
 			if err != nil {
 				panic(err)
@@ -109,3 +249,12 @@ func pruneDeletedFiles(backupPath string, filesMap map[string]os.FileInfo, tx *s
 		panic(err)
 	}
 }
+
+func underFailure(path string, failed []string) bool {
+	for _, f := range failed {
+		if path == f || (strings.HasSuffix(f, "/") && strings.HasPrefix(path, f)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leijurv/gb/config"
+)
+
+func TestUnreadableFolderIsLeftAlone(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read anything, so there's no way to make a folder unreadable")
+	}
+	WithTestingDatabase(t, func() {
+		src, err := ioutil.TempDir("", "gb-src-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(src)
+		locked := filepath.Join(src, "locked")
+		err = os.Mkdir(locked, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(locked, "a"), []byte("aaa"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(src, "b"), []byte("bbb"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backupADirectoryRecursively(src)
+
+		nextBackup()
+		err = os.Chmod(locked, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(locked, 0755)
+		err = ioutil.WriteFile(filepath.Join(src, "c"), []byte("ccc"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanErrors = scanErrors[:0]
+		backupADirectoryRecursively(src)
+		if len(scanErrors) != 1 || scanErrors[0].path != locked {
+			t.Errorf("expected the locked folder to be the only error, got %v", scanErrors)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM files WHERE path = ? AND end IS NULL", filepath.Join(locked, "a")); n != 1 {
+			t.Errorf("a couldn't be seen, so it shouldn't have been marked as deleted")
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM files WHERE path = ? AND end IS NULL", filepath.Join(src, "c")); n != 1 {
+			t.Errorf("the rest of the scan should have been committed")
+		}
+	})
+}
+
+func TestPruneSkipsFailures(t *testing.T) {
+	WithTestingDatabase(t, func() {
+		hash := randBytes(32)
+		_, err := db.Exec("INSERT INTO hashes (hash, size) VALUES (?, 0)", hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{"/src/a", "/src/dir/b", "/src/dir/c/d", "/src/dir2/e", "/src/f"} {
+			_, err = db.Exec("INSERT INTO files (path, hash, start, fs_modified) VALUES (?, ?, ?, ?)", path, hash, now, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		nextBackup()
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pruneDeletedFiles("/src/", make(map[string]os.FileInfo), NewIgnorer(), []string{"/src/dir/", "/src/f"}, tx)
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for path, current := range map[string]bool{"/src/a": false, "/src/dir/b": true, "/src/dir/c/d": true, "/src/dir2/e": false, "/src/f": true} {
+			if n := countRows(t, "SELECT COUNT(*) FROM files WHERE path = ? AND end IS NULL", path); (n == 1) != current {
+				t.Errorf("%s: expected current to be %v", path, current)
+			}
+		}
+	})
+}
+
+func TestChangingFileIsSkipped(t *testing.T) {
+	// files in /proc say they're empty, but aren't, which looks exactly like a file that keeps changing
+	const path = "/proc/self/stat"
+	info, err := os.Lstat(path)
+	if err != nil || info.Size() != 0 {
+		t.Skip("need a /proc that lies about sizes")
+	}
+	defer func(old time.Duration) { changingRetryDelay = old }(changingRetryDelay)
+	changingRetryDelay = 0
+	res := scanResult{path: path, info: info}
+	hashFile(&res)
+	if res.err != errChangedWhileReading || res.hash != nil {
+		t.Errorf("expected it to give up, got %v %v", res.hash, res.err)
+	}
+	failed := saveScanResult(res, nil, nil) // doesn't need the database, since there's nothing to save
+	if len(failed) != 1 || failed[0] != path {
+		t.Errorf("it should be left as it was, got %v", failed)
+	}
+}
+
+func TestHashWorkers(t *testing.T) {
+	old := config.Config()
+	defer config.SetConfig(old)
+	c := old
+	c.HashWorkers = 8
+	c.HashWorkersPerRoot = map[string]int{"/mnt/hdd": 1, "/mnt/hdd/cache/": 3, "/mnt/hd": 5}
+	config.SetConfig(c)
+	for root, expected := range map[string]int{"/home/me/": 8, "/mnt/hdd/": 1, "/mnt/hdd/photos/": 1, "/mnt/hdd/cache/x/": 3, "/mnt/hdd2/": 8} {
+		if n := hashWorkers(root); n != expected {
+			t.Errorf("%s: expected %d workers, got %d", root, expected, n)
+		}
+	}
+}
+
+func TestParallelScan(t *testing.T) {
+	WithTestingDatabase(t, func() {
+		src, err := ioutil.TempDir("", "gb-src-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(src)
+		for i := 0; i < 100; i++ {
+			dir := filepath.Join(src, fmt.Sprint(i%7))
+			err = os.MkdirAll(dir, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// some of them have the same contents, so they race to insert the same hash
+			err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(i)), []byte(fmt.Sprint(i%10)), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		old := config.Config()
+		defer config.SetConfig(old)
+		c := old
+		c.HashWorkers = 8
+		config.SetConfig(c)
+		backupADirectoryRecursively(src)
+		if n := countRows(t, "SELECT COUNT(*) FROM files WHERE end IS NULL"); n != 100 {
+			t.Errorf("expected 100 files, got %d", n)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM hashes"); n != 10 {
+			t.Errorf("expected 10 distinct hashes, got %d", n)
+		}
+		nextBackup()
+		err = ioutil.WriteFile(filepath.Join(src, "0", "0"), []byte("changed"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(filepath.Join(src, "0", "0"), time.Unix(now+100, 0), time.Unix(now+100, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		backupADirectoryRecursively(src)
+		if n := countRows(t, "SELECT COUNT(*) FROM files"); n != 101 {
+			t.Errorf("only the one changed file should have a new version, got %d rows", n)
+		}
+	})
+}
+
+func TestUnreadableExcludedFolder(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read anything, so there's no way to make a folder unreadable")
+	}
+	WithTestingDatabase(t, func() {
+		src, err := ioutil.TempDir("", "gb-src-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(src)
+		cache := filepath.Join(src, "cache")
+		err = os.Mkdir(cache, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(cache, "a"), []byte("aaa"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backupADirectoryRecursively(src)
+
+		nextBackup()
+		err = os.Chmod(cache, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(cache, 0755)
+		err = ioutil.WriteFile(filepath.Join(src, ignoreFileName), []byte("cache/\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanErrors = scanErrors[:0]
+		backupADirectoryRecursively(src)
+		if len(scanErrors) != 0 {
+			t.Errorf("an excluded folder being unreadable isn't an error, got %v", scanErrors)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM files WHERE path = ? AND end IS NULL", filepath.Join(cache, "a")); n != 0 {
+			t.Errorf("a is excluded now, so it should have been ended")
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM excluded WHERE path = ?", filepath.Join(cache, "a")); n != 1 {
+			t.Errorf("a should be remembered as excluded")
+		}
+	})
+}
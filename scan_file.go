@@ -2,21 +2,61 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/leijurv/gb/config"
 )
 
-func backupOneFile(path string, info os.FileInfo, tx *sql.Tx) {
+// what happened with one path during a scan, for the writer to apply to the database
+// the walk fills in what it knows, and if hash is still nil (and there's no error), a hashing worker reads the file and fills in the rest
+type scanResult struct {
+	path          string
+	info          os.FileInfo
+	expectedHash  []byte // what the files table says this path has now, nil if it's a new file
+	err           error  // it couldn't be read, so it should be left as it was
+	dir           bool   // the error was for a whole folder
+	metadataOnly  bool   // same contents, but the metadata changed
+	staleMetadata bool   // same contents and metadata, but the saved metadata needs updating in place
+	hash          []byte
+	size          int64
+	meta          fileMetadata
+}
+
+func (res scanResult) needsHash() bool {
+	return res.hash == nil && res.err == nil
+}
+
+// decides what to do about a file, only reading from the database (the writer is the only one that writes)
+// returns non-nil toUp if this file should skip hashing here, and be hashed while it's being uploaded instead
+// returns non-nil res if the writer needs to do something about it, after hashing it if res.needsHash()
+// returns nil, nil if it's unchanged
+func checkFile(path string, info os.FileInfo, tx *sql.Tx) (*ToUpload, *scanResult) {
+	meta := readMetadata(path, info)
 	var expectedLastModifiedTime int64
 	var expectedHash []byte
 	err := tx.QueryRow("SELECT fs_modified, hash FROM files WHERE path = ? AND end IS NULL", path).Scan(&expectedLastModifiedTime, &expectedHash)
 	if err == nil {
-		if expectedLastModifiedTime == info.ModTime().Unix() {
+		if expectedLastModifiedTime == info.ModTime().Unix() && !symlinkRepointed(path, info, expectedHash) {
+			changed, stale := compareMetadata(path, meta, tx)
+			if changed {
+				// same contents, but e.g. chmod, which doesn't change the last modified time
+				return nil, &scanResult{path: path, info: info, expectedHash: expectedHash, metadataOnly: true, hash: expectedHash, meta: meta}
+			}
+			if stale {
+				return nil, &scanResult{path: path, info: info, expectedHash: expectedHash, staleMetadata: true, hash: expectedHash, meta: meta}
+			}
 			log.Println("UNMODIFIED:", path, "ModTime is still", expectedLastModifiedTime)
-			return
+			return nil, nil
 		}
 		log.Println("MODIFIED:", path, "Was previously stored, but I'm updating it since the last modified time has changed from", expectedLastModifiedTime, "to", info.ModTime().Unix())
 	} else {
@@ -25,34 +65,163 @@ func backupOneFile(path string, info os.FileInfo, tx *sql.Tx) {
 		}
 	}
 
-	// TODO
-	// db.QueryRow("SELECT FROM hashes WHERE size = ?")
-	// if no rows, AND size greater than 16mb, skip directly to blob creation
+	if info.Mode().IsRegular() && info.Size() >= config.Config().MinBlobSize && !sizeExists(info.Size(), tx) && storageExists(tx) {
+		// nothing we've ever seen is this size, so this can't possibly be a duplicate of anything
+		// and it's big, so it'll get its own blob anyway
+		// so, don't read the whole thing now just to read it all again during upload
+		// (unless there's nowhere to upload to, then there won't be an upload to hash it in, so it has to be hashed now)
+		log.Println("NEW SIZE:", path, "is", info.Size(), "bytes, which is a size I've never seen before. Going to hash it while uploading it instead of now")
+		return &ToUpload{
+			hash:    nil,
+			size:    info.Size(),
+			options: []UploadSource{{path, info.ModTime().Unix(), false, &meta}},
+		}, nil
+	}
+	return nil, &scanResult{path: path, info: info, expectedHash: expectedHash}
+}
+
+// a file that was being written to the whole time we were trying to read it, e.g. a busy log file
+var errChangedWhileReading = errors.New("changed while it was being read")
+
+// how many times to try reading a file that keeps changing, and how long to wait in between
+const changingAttempts = 3
 
+var changingRetryDelay = time.Second
+
+// fills in the hash, size and metadata, or the error if it couldn't be read
+// this runs in a hashing worker, so it mustn't touch the database
+func hashFile(res *scanResult) {
+	for attempt := 1; ; attempt++ {
+		res.hash, res.size, res.err = tryHashFile(res.path, res.info)
+		if res.err != errChangedWhileReading || attempt == changingAttempts {
+			break
+		}
+		log.Println(res.path, "changed while I was reading it, trying again in", changingRetryDelay)
+		time.Sleep(changingRetryDelay)
+		info, err := os.Lstat(res.path)
+		if err != nil {
+			res.err = err
+			break
+		}
+		res.info = info
+	}
+	if res.err == nil {
+		res.meta = readMetadata(res.path, res.info)
+	}
+}
+
+func tryHashFile(path string, info os.FileInfo) ([]byte, int64, error) {
 	// now, it's time to hash the file to see if it needs to be backed up or if we've already got it
 	log.Println("Beginning read for sha256 calc:", path)
 
-	f, err := os.Open(path)
+	f, _, err := openSource(path)
 	if err != nil {
-		panic(err)
+		return nil, 0, err
 	}
 	defer f.Close()
 
 	hs := NewSHA256HasherSizer()
 	if _, err := io.Copy(&hs, f); err != nil {
-		panic(err)
+		return nil, 0, err
 	}
 	hash, size := hs.HashAndSize()
 	if size != info.Size() {
-		panic("You really be changing things while I'm reading them huh " + path)
+		log.Println("You really be changing things while I'm reading them huh", path, "was", info.Size(), "bytes but I read", size)
+		return nil, 0, errChangedWhileReading
+	}
+	after, err := os.Lstat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if after.Size() != info.Size() || !after.ModTime().Equal(info.ModTime()) {
+		log.Println("You really be changing things while I'm reading them huh", path, "was modified during the read")
+		return nil, 0, errChangedWhileReading
 	}
 
 	log.Println("sha256 is", hex.EncodeToString(hash), "and length is", size)
+	return hash, size, nil
+}
+
+// a symlink can be pointed somewhere else within the same second, and reading where it points is as cheap as the stat anyway, so always check
+func symlinkRepointed(path string, info os.FileInfo, expectedHash []byte) bool {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	target, err := os.Readlink(path)
+	if err != nil {
+		return true // let the full read deal with it
+	}
+	hash := sha256.Sum256([]byte(target))
+	return !bytes.Equal(hash[:], expectedHash)
+}
+
+// fifos and devices are backed up as just their metadata, with empty contents
+// a socket only means something while whatever made it is running, so those aren't backed up at all
+func isSpecial(mode os.FileMode) bool {
+	return mode&(os.ModeNamedPipe|os.ModeDevice) != 0
+}
+
+func canBackUp(mode os.FileMode) bool {
+	return mode.IsRegular() || mode&os.ModeSymlink != 0 || isSpecial(mode)
+}
+
+// the contents of a file as far as gb is concerned
+// for a symlink that's where it points (never what it points to, that might not even be in the backup), and it's marked as a link in its metadata
+// for a fifo or a device it's nothing, they never get read from (a fifo would block forever)
+func openSource(path string) (io.ReadCloser, os.FileInfo, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ioutil.NopCloser(strings.NewReader(target)), info, nil
+	}
+	if isSpecial(info.Mode()) {
+		return ioutil.NopCloser(strings.NewReader("")), info, nil
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("%s is not something that can be backed up, its mode is %v", path, info.Mode())
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, info, nil
+}
 
+func storageExists(tx *sql.Tx) bool {
+	var exists bool
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM storage)").Scan(&exists)
+	if err != nil {
+		panic(err)
+	}
+	return exists
+}
+
+func sizeExists(size int64, tx *sql.Tx) bool {
+	var exists bool
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM hashes WHERE size = ?)", size).Scan(&exists) // uses hashes_by_size
+	if err != nil {
+		panic(err)
+	}
+	return exists
+}
+
+// a file has been read and this is its hash, so make the files table match that
+// expectedHash is what the files table currently says this path has, or nil if it's a new file
+func saveFileHash(path string, hash []byte, size int64, fsModified int64, meta fileMetadata, expectedHash []byte, tx *sql.Tx) {
 	if bytes.Equal(hash, expectedHash) {
 		log.Println("This hash is unchanged from last time, even though last modified is changed...?")
+		if metadataChanged(path, meta, tx) {
+			newVersion(path, hash, fsModified, meta, tx)
+			return
+		}
 		log.Println("Updating fs_modifed in db so next time I don't reread this for no reason lol")
-		_, err := tx.Exec("UPDATE files SET fs_modified = ? WHERE path = ? AND end IS NULL", info.ModTime().Unix(), path)
+		_, err := tx.Exec("UPDATE files SET fs_modified = ? WHERE path = ? AND end IS NULL", fsModified, path)
 		if err != nil {
 			panic(err)
 		}
@@ -65,17 +234,24 @@ func backupOneFile(path string, info os.FileInfo, tx *sql.Tx) {
 		log.Println(path, "hash has changed from", hex.EncodeToString(expectedHash), "to", hex.EncodeToString(hash))
 	}
 
-	_, err = tx.Exec("UPDATE files SET end = ? WHERE end IS NULL AND path = ?", now, path)
+	// ignore uniqueness constraint error: it's very possible a different file with identical contents (identical hash) was already added to this table
+	_, err := tx.Exec("INSERT OR IGNORE INTO hashes (hash, size) VALUES (?, ?)", hash, size)
 	if err != nil {
 		panic(err)
 	}
-	// ignore uniqueness constraint error: it's very possible a different file with identical contents (identical hash) was already added to this table
-	_, err = tx.Exec("INSERT OR IGNORE INTO hashes (hash, size) VALUES (?, ?)", hash, size)
+	newVersion(path, hash, fsModified, meta, tx)
+}
+
+// end the current version of this path, if any, and start a new one as of now
+// the hash must already be in the hashes table
+func newVersion(path string, hash []byte, fsModified int64, meta fileMetadata, tx *sql.Tx) {
+	_, err := tx.Exec("UPDATE files SET end = ? WHERE end IS NULL AND path = ?", now, path)
 	if err != nil {
 		panic(err)
 	}
-	_, err = tx.Exec("INSERT INTO files (path, hash, start, fs_modified) VALUES (?, ?, ?, ?)", path, hash, now, info.ModTime().Unix())
+	_, err = tx.Exec("INSERT INTO files (path, hash, start, fs_modified) VALUES (?, ?, ?, ?)", path, hash, now, fsModified)
 	if err != nil {
 		panic(err)
 	}
+	saveMetadata(path, now, meta, tx)
 }
@@ -103,6 +103,26 @@ func createTables() error {
 		log.Println("Unable to create blob_entries table")
 		return err
 	}
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS file_chunks (
+
+		hash       BLOB    NOT NULL, /* hash of the whole file */
+		idx        INTEGER NOT NULL, /* this is the idx-th chunk of the file, starting at 0 */
+		chunk_hash BLOB    NOT NULL, /* hash of just this chunk, which has its own blob entry */
+		offset     INTEGER NOT NULL, /* where in the file this chunk starts */
+
+		PRIMARY KEY(hash, idx),
+		CHECK(idx >= 0),
+		CHECK(offset >= 0),
+
+		FOREIGN KEY(hash)       REFERENCES hashes(hash) ON UPDATE RESTRICT ON DELETE RESTRICT,
+		FOREIGN KEY(chunk_hash) REFERENCES hashes(hash) ON UPDATE RESTRICT ON DELETE RESTRICT
+	);
+	CREATE INDEX IF NOT EXISTS file_chunks_by_chunk_hash ON file_chunks(chunk_hash);
+	`)
+	if err != nil {
+		log.Println("Unable to create file_chunks table")
+		return err
+	}
 	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS storage (
 
 		storage_id     BLOB NOT NULL PRIMARY KEY, /* identifier for this location in which we are  */
@@ -143,5 +163,75 @@ func createTables() error {
 		log.Println("Unable to create blob_storage table")
 		return err
 	}
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS s3_options (
+
+		storage_id BLOB    NOT NULL PRIMARY KEY, /* which S3 storage this is for */
+		endpoint   TEXT,                      /* endpoint url for S3-compatible providers (minio, b2, wasabi...). NULL means actual AWS */
+		region     TEXT    NOT NULL,
+		path_style INTEGER NOT NULL,          /* 1 to put the bucket in the path instead of the hostname, most non-AWS providers want this */
+		profile    TEXT,                      /* profile in ~/.aws/credentials to use. NULL means the default credential chain */
+
+		CHECK(endpoint IS NULL OR LENGTH(endpoint) > 0),
+		CHECK(LENGTH(region) > 0),
+		CHECK(path_style == 0 OR path_style == 1),
+		CHECK(profile IS NULL OR LENGTH(profile) > 0),
+
+		FOREIGN KEY(storage_id) REFERENCES storage(storage_id) ON UPDATE CASCADE ON DELETE CASCADE
+	);
+	`)
+	if err != nil {
+		log.Println("Unable to create s3_options table")
+		return err
+	}
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS metadata (
+
+		path     TEXT    NOT NULL, /* the files row this is for */
+		start    INTEGER NOT NULL,
+		mode     INTEGER NOT NULL, /* go os.FileMode, which has the permission bits, setuid etc, and what kind of file this is */
+		uid      INTEGER,          /* NULL if the OS doesn't have such a thing */
+		gid      INTEGER,
+		mtime_ns INTEGER NOT NULL, /* last modified in unix nanoseconds. unlike fs_modified, this is only for restoring, not for deciding what to rehash */
+		rdev     INTEGER,          /* device number, only for device files */
+
+		PRIMARY KEY(path, start),
+
+		FOREIGN KEY(path, start) REFERENCES files(path, start) ON UPDATE CASCADE ON DELETE CASCADE
+	);
+	`)
+	if err != nil {
+		log.Println("Unable to create metadata table")
+		return err
+	}
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS xattrs (
+
+		path  TEXT    NOT NULL, /* the files row this is for */
+		start INTEGER NOT NULL,
+		name  TEXT    NOT NULL,
+		value BLOB    NOT NULL,
+
+		PRIMARY KEY(path, start, name),
+		CHECK(LENGTH(name) > 0),
+
+		FOREIGN KEY(path, start) REFERENCES files(path, start) ON UPDATE CASCADE ON DELETE CASCADE
+	);
+	`)
+	if err != nil {
+		log.Println("Unable to create xattrs table")
+		return err
+	}
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS excluded (
+
+		path  TEXT    NOT NULL, /* a files row that was ended because it matched an exclude pattern, not because it was deleted */
+		start INTEGER NOT NULL,
+
+		PRIMARY KEY(path, start),
+
+		FOREIGN KEY(path, start) REFERENCES files(path, start) ON UPDATE CASCADE ON DELETE CASCADE
+	);
+	`)
+	if err != nil {
+		log.Println("Unable to create excluded table")
+		return err
+	}
 	return nil
 }
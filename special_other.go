@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+)
+
+// only linux and mac for now
+func makeSpecial(path string, meta *fileMetadata) error {
+	return errors.New("can't make fifos or devices on this OS")
+}
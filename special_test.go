@@ -0,0 +1,60 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"crypto/sha256"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSpecialFiles(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		err := syscall.Mkfifo(filepath.Join(src, "fifo"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := net.Listen("unix", filepath.Join(src, "socket"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		done := make(chan bool)
+		go func() {
+			upload(backupADirectoryRecursively(src))
+			done <- true
+		}()
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			t.Fatal("backing up a fifo shouldn't block")
+		}
+
+		empty := sha256.Sum256(nil)
+		if n := countRows(t, "SELECT COUNT(*) FROM files WHERE path = ? AND hash = ?", filepath.Join(src, "fifo"), empty[:]); n != 1 {
+			t.Errorf("the fifo should be backed up with empty contents")
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM files WHERE path = ?", filepath.Join(src, "socket")); n != 0 {
+			t.Errorf("the socket shouldn't be backed up")
+		}
+		testAll()
+
+		to := filepath.Join(dest, "restored")
+		if failures := restore(src, now, to); failures != 0 {
+			t.Fatalf("%d failures", failures)
+		}
+		info, err := os.Lstat(filepath.Join(to, "fifo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&os.ModeNamedPipe == 0 || info.Mode().Perm() != 0600 {
+			t.Errorf("the fifo was restored as %v", info.Mode())
+		}
+	})
+}
@@ -0,0 +1,28 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func makeSpecial(path string, meta *fileMetadata) error {
+	perm := uint32(meta.mode.Perm())
+	switch {
+	case meta.mode&os.ModeNamedPipe != 0:
+		return syscall.Mkfifo(path, perm)
+	case meta.mode&os.ModeDevice != 0:
+		if meta.rdev == nil {
+			return errors.New("no device number was saved")
+		}
+		kind := uint32(syscall.S_IFBLK)
+		if meta.mode&os.ModeCharDevice != 0 {
+			kind = syscall.S_IFCHR
+		}
+		return syscall.Mknod(path, kind|perm, int(*meta.rdev))
+	}
+	return errors.New("not a fifo or a device")
+}
@@ -2,21 +2,32 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"io"
+	"log"
+
+	"github.com/leijurv/gb/config"
 )
 
 type Storage interface {
 	BeginBlobUpload(blobID []byte) StorageUpload
 	DownloadSection(blobID []byte, offset int64, length int64) io.Reader
 	GetID() []byte
+	Delete(path string) // path is as in blob_storage.full_path
+	List() []ListedBlob // everything under the root path, whether or not the database knows about it
 }
 type CompletedUpload struct {
 	path     string
 	checksum string
 }
+type ListedBlob struct {
+	path string // same format as blob_storage.full_path
+	size int64
+}
 type StorageUpload interface {
 	Begin() io.Writer
 	End() CompletedUpload
+	Abort() // give up partway through, leaving nothing behind at the path
 }
 
 func GetAll(tx *sql.Tx) []Storage {
@@ -25,33 +36,179 @@ func GetAll(tx *sql.Tx) []Storage {
 		panic(err)
 	}
 	defer rows.Close()
-	storages := make([]Storage, 0)
+	type storageData struct {
+		storageID  []byte
+		kind       string // owo
+		identifier string
+		rootPath   string
+	}
+	datas := make([]storageData, 0)
 	for rows.Next() {
-		var storageID []byte
-		var kind string // owo
-		var identifier string
-		var rootPath string
-		err := rows.Scan(&storageID, &kind, &identifier, &rootPath)
+		var data storageData
+		err := rows.Scan(&data.storageID, &data.kind, &data.identifier, &data.rootPath)
 		if err != nil {
 			panic(err)
 		}
-		storages = append(storages, StorageDataToStorage(storageID, kind, identifier, rootPath))
+		datas = append(datas, data)
 	}
 	err = rows.Err()
 	if err != nil {
 		panic(err)
 	}
+	rows.Close() // done with this query before StorageDataToStorage makes more
+	storages := make([]Storage, 0)
+	for _, data := range datas {
+		storages = append(storages, StorageDataToStorage(data.storageID, data.kind, data.identifier, data.rootPath, tx))
+	}
 	return storages
 }
-func StorageDataToStorage(storageID []byte, kind string, identifier string, rootPath string) Storage {
+func StorageDataToStorage(storageID []byte, kind string, identifier string, rootPath string, tx *sql.Tx) Storage {
 	switch kind {
 	case "S3":
 		return &S3{
 			storageID: storageID,
 			bucket:    identifier,
 			rootPath:  rootPath,
+			options:   loadS3Options(storageID, tx),
+		}
+	case "Disk":
+		return &Disk{
+			storageID:  storageID,
+			identifier: identifier,
+			rootPath:   rootPath,
 		}
 	default:
 		panic("Unknown storage type " + kind)
 	}
 }
+
+// lower is better, i.e. read from this first
+// the config lists labels and types, whichever comes first wins
+func storagePreference(label string, kind string) int {
+	prefs := config.Config().StoragePreference
+	for i, pref := range prefs {
+		if pref == label || pref == kind {
+			return i
+		}
+	}
+	return len(prefs)
+}
+
+// s3Options is only used (and required) for S3 storages
+func addStorage(label string, kind string, identifier string, rootPath string, s3Options *S3Options) {
+	switch kind {
+	case "S3":
+		if s3Options == nil {
+			panic("S3 storage needs options")
+		}
+	case "Disk":
+	default:
+		usageError("Unknown storage type " + kind + ", must be S3 or Disk")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		err = tx.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	storageID := randBytes(32)
+	_, err = tx.Exec("INSERT INTO storage (storage_id, readable_label, type, identifier, root_path) VALUES (?, ?, ?, ?, ?)", storageID, label, kind, identifier, rootPath)
+	if err != nil {
+		log.Println("Unable to add storage. Is that label, or that type and identifier, already in use?")
+		panic(err)
+	}
+	if kind == "S3" {
+		saveS3Options(storageID, *s3Options, tx)
+	}
+	log.Println("Added storage", label)
+}
+
+func listStorages() {
+	rows, err := db.Query(`
+		SELECT
+			storage.readable_label,
+			storage.type,
+			storage.identifier,
+			storage.root_path,
+			COUNT(blobs.blob_id),
+			COALESCE(SUM(blobs.size), 0)
+		FROM storage
+			LEFT OUTER JOIN blob_storage ON blob_storage.storage_id = storage.storage_id
+			LEFT OUTER JOIN blobs ON blobs.blob_id = blob_storage.blob_id
+		GROUP BY storage.storage_id
+		ORDER BY storage.readable_label
+	`)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var label string
+		var kind string
+		var identifier string
+		var rootPath string
+		var numBlobs int64
+		var totalSize int64
+		err := rows.Scan(&label, &kind, &identifier, &rootPath, &numBlobs, &totalSize)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%d blobs\t%d bytes\n", label, kind, identifier, rootPath, numBlobs, totalSize)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func labelStorage(oldLabel string, newLabel string) {
+	result, err := db.Exec("UPDATE storage SET readable_label = ? WHERE readable_label = ?", newLabel, oldLabel)
+	if err != nil {
+		panic(err)
+	}
+	requireOneRow(result, oldLabel)
+	log.Println("Renamed", oldLabel, "to", newLabel)
+}
+
+func removeStorage(label string) {
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		err = tx.Commit()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	var numBlobs int64
+	err = tx.QueryRow("SELECT COUNT(*) FROM blob_storage INNER JOIN storage ON storage.storage_id = blob_storage.storage_id WHERE storage.readable_label = ?", label).Scan(&numBlobs)
+	if err != nil {
+		panic(err)
+	}
+	if numBlobs > 0 {
+		// blob_storage is ON DELETE RESTRICT so the delete would fail anyway, this is just a nicer message
+		tx.Rollback()
+		usageError("Storage", label, "still has", numBlobs, "blobs on it. Refusing to forget about them.")
+	}
+	result, err := tx.Exec("DELETE FROM storage WHERE readable_label = ?", label)
+	if err != nil {
+		panic(err)
+	}
+	requireOneRow(result, label)
+	log.Println("Removed storage", label)
+}
+
+func requireOneRow(result sql.Result, label string) {
+	n, err := result.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	if n != 1 {
+		usageError("No storage with label", label)
+	}
+}
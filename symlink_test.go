@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSymlinks(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		err := ioutil.WriteFile(filepath.Join(src, "a"), []byte("aaa"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outside, err := ioutil.TempDir("", "gb-outside-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(outside)
+		err = ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("not part of the backup"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		links := map[string]string{
+			"link":     "a",
+			"dangling": "/this/does/not/exist",
+			"outside":  outside, // a folder, that must not be followed
+		}
+		for name, target := range links {
+			err = os.Symlink(target, filepath.Join(src, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		upload(backupADirectoryRecursively(src))
+		if n := countRows(t, "SELECT COUNT(*) FROM files"); n != 4 {
+			t.Fatalf("expected a and 3 links, got %d files", n)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM files WHERE path LIKE '%secret'"); n != 0 {
+			t.Fatalf("followed a link out of the backup")
+		}
+		for name, target := range links {
+			hash := sha256.Sum256([]byte(target))
+			if n := countRows(t, "SELECT COUNT(*) FROM files WHERE path = ? AND hash = ?", filepath.Join(src, name), hash[:]); n != 1 {
+				t.Errorf("%s should be saved as the hash of its target", name)
+			}
+		}
+		testAll()
+
+		// pointing somewhere else is a new version
+		nextBackup()
+		err = os.Remove(filepath.Join(src, "link"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Symlink("b", filepath.Join(src, "link"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(backupADirectoryRecursively(src))
+		if n := countRows(t, "SELECT COUNT(*) FROM files WHERE path = ?", filepath.Join(src, "link")); n != 2 {
+			t.Errorf("expected 2 versions of the link, got %d", n)
+		}
+
+		to := filepath.Join(dest, "restored")
+		if failures := restore(src, now, to); failures != 0 {
+			t.Fatalf("%d failures", failures)
+		}
+		links["link"] = "b"
+		for name, target := range links {
+			info, err := os.Lstat(filepath.Join(to, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				t.Errorf("%s should be restored as a link, but it's %v", name, info.Mode())
+				continue
+			}
+			restoredTarget, err := os.Readlink(filepath.Join(to, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restoredTarget != target {
+				t.Errorf("%s should point to %s, but points to %s", name, target, restoredTarget)
+			}
+		}
+	})
+}
@@ -9,21 +9,36 @@ import (
 	"log"
 	"os"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/leijurv/gb/config"
 )
 
 // a hash that we indend to upload, and the places on disk where we believe we will be able to find files containing this hash's original data
+// hash can be nil, for a file that hasn't been hashed yet, and will be hashed as it's uploaded (then its files row gets written afterwards)
+// repack means this hash already has a blob entry somewhere else, and that entry should be moved into the new blob
 type ToUpload struct {
 	hash    []byte
 	size    int64
 	options []UploadSource
+	repack  bool
 }
 
+// fromStorage means read the hash back out of a blob we already uploaded, instead of from a file on disk
+// metadata is only for a file that hasn't been hashed yet, so it can be saved along with the hash afterwards
 type UploadSource struct {
 	path        string
 	fs_modified int64
+	fromStorage bool
+	metadata    *fileMetadata
+}
+
+// a file from hashLater that was just hashed for the first time, while it was being added to a blob
+type hashedDuringUpload struct {
+	source UploadSource
+	hash   []byte
+	size   int64
 }
 
 // note that padding and location cannot be calculated until after the files to upload have been read and compressed
@@ -38,28 +53,205 @@ type BlobEntry struct {
 	compression *string
 }
 
-func upload() {
+// a blob that has been written to every storage, and everything about it that still needs to go in the database
+type builtBlob struct {
+	blobID       []byte
+	key          []byte
+	size         int64
+	hashPreEnc   []byte
+	hashPostEnc  []byte
+	entries      []BlobEntry
+	repacked     []BlobEntry
+	hashedNow    []hashedDuringUpload
+	chunkedFiles []chunkedFile
+	completeds   []CompletedUpload
+	failure      interface{} // if building it panicked, what the panic was
+}
+
+// zeros written at the end of every blob
+const blobPadding = 5021
+
+// hashLater is files that the scan decided to not hash yet (see checkFile)
+func upload(hashLater []ToUpload) {
+	blobPlans, storages := planUpload(hashLater)
+	if len(storages) == 0 {
+		log.Println("There's nowhere to upload to! Add a storage with `gb storage add` first")
+		return
+	}
+	// each blob is committed on its own, so if this gets interrupted, the next run only has to do what's left
+	executeAll(blobPlans, storages)
+}
+
+func planUpload(hashLater []ToUpload) ([]BlobPlan, []Storage) {
 	log.Println("Checking for files to upload")
 	tx, err := db.Begin()
 	if err != nil {
 		panic(err)
 	}
 	defer func() {
-		log.Println("Committing to database")
 		err = tx.Commit()
 		if err != nil {
 			panic(err)
 		}
-		log.Println("Done")
 	}()
-	plan := calcToUpload(tx)
+	storages := GetAll(tx)
+	if len(storages) == 0 {
+		return nil, nil
+	}
+	plan := append(calcToUpload(tx), hashLater...)
 	log.Println("ToUps", plan)
 	blobPlans := bucket(plan)
 	log.Println("BlobPlans", blobPlans)
-	for _, blobPlan := range blobPlans {
-		log.Println("Executing", blobPlan)
-		execute(blobPlan, tx, GetAll(tx))
+	return blobPlans, storages
+}
+
+// the transaction that finished blobs get saved into, which is committed and replaced after each one
+// the builders read from it too (and only read), so they take the read lock for as long as they're using it, and committing takes the write lock
+type blobTx struct {
+	lock sync.RWMutex
+	tx   *sql.Tx
+}
+
+func beginBlobTx() *blobTx {
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	return &blobTx{tx: tx}
+}
+
+func (b *blobTx) entryExists(hash []byte) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return entryExists(hash, b.tx)
+}
+
+// read an entry back out of storage, holding the read lock until the reader is closed, since cat keeps reading from the database until it's done
+// returns nil if no storage can give it back, so the caller can treat it like any other option that's no longer usable
+func (b *blobTx) cat(hash []byte) (r io.ReadCloser) {
+	b.lock.RLock()
+	defer func() {
+		if err := recover(); err != nil {
+			b.lock.RUnlock()
+			log.Println("Unable to read", hex.EncodeToString(hash), "back out of storage:", err)
+			r = nil
+		}
+	}()
+	return lockedReader{cat(hash, b.tx), b.lock.RUnlock}
+}
+
+// save a finished blob and commit it right away
+func (b *blobTx) save(blob builtBlob, storages []Storage) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	saveBlob(blob, b.tx, storages)
+	log.Println("Committing blob", hex.EncodeToString(blob.blobID), "to database")
+	err := b.tx.Commit()
+	if err != nil {
+		panic(err)
+	}
+	b.tx, err = db.Begin()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (b *blobTx) end() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err := b.tx.Commit()
+	if err != nil {
+		panic(err)
+	}
+	log.Println("Done")
+}
+
+// a reader that holds on to the read lock until it's closed
+type lockedReader struct {
+	io.Reader
+	unlock func()
+}
+
+func (r lockedReader) Close() error {
+	r.unlock()
+	return nil
+}
+
+// builds and uploads several blobs at once, and saves each one to the database as it finishes
+// the builders only read from the database, and this goroutine is the only one that writes to it
+func executeAll(blobPlans []BlobPlan, storages []Storage) {
+	btx := beginBlobTx()
+	defer btx.end()
+	limit := uploadConcurrency(storages, btx.tx) // nothing else is using it yet
+	log.Println("Uploading up to", limit, "blobs at once")
+	slots := make(chan struct{}, limit)
+	built := make(chan builtBlob)
+	go func() {
+		var building sync.WaitGroup
+		for _, blobPlan := range blobPlans {
+			slots <- struct{}{}
+			building.Add(1)
+			go func(blobPlan BlobPlan) {
+				defer building.Done()
+				defer func() { <-slots }()
+				built <- executeRecovering(blobPlan, btx, storages)
+			}(blobPlan)
+		}
+		building.Wait()
+		close(built)
+	}()
+	var failure interface{}
+	for blob := range built {
+		if blob.failure != nil {
+			// let the rest finish and get saved, so that what they uploaded isn't wasted
+			log.Println("Building a blob failed:", blob.failure)
+			if failure == nil {
+				failure = blob.failure
+			}
+			continue
+		}
+		btx.save(blob, storages)
 	}
+	if failure != nil {
+		panic(failure)
+	}
+}
+
+// a panic in a builder goroutine would take the whole process down without saving the other blobs, so it gets passed back instead
+func executeRecovering(plan BlobPlan, btx *blobTx, storages []Storage) (blob builtBlob) {
+	defer func() {
+		if r := recover(); r != nil {
+			blob = builtBlob{failure: r}
+		}
+	}()
+	log.Println("Executing", plan)
+	return execute(plan, btx, storages)
+}
+
+// every blob goes to every storage at the same time, so the lowest limit of any of them is the limit
+// a storage's limit can be set by its label or by its type, the label wins
+func uploadConcurrency(storages []Storage, tx *sql.Tx) int {
+	limit := config.Config().UploadConcurrency
+	perStorage := config.Config().UploadConcurrencyPerStorage
+	for _, storage := range storages {
+		var label string
+		var kind string
+		err := tx.QueryRow("SELECT readable_label, type FROM storage WHERE storage_id = ?", storage.GetID()).Scan(&label, &kind)
+		if err != nil {
+			panic(err)
+		}
+		n, ok := perStorage[label]
+		if !ok {
+			n, ok = perStorage[kind]
+		}
+		if ok && n < limit {
+			limit = n
+		}
+	}
+	if limit < 1 {
+		return 1
+	}
+	return limit
 }
 
 func bucket(toUps []ToUpload) []BlobPlan {
@@ -92,10 +284,18 @@ func bucket(toUps []ToUpload) []BlobPlan {
 	return blobPlans
 }
 
-func execute(plan BlobPlan, tx *sql.Tx, storageDests []Storage) {
+// writes one blob to every storage, only reading from the database
+// saveBlob does the rest once it's done
+func execute(plan BlobPlan, btx *blobTx, storageDests []Storage) builtBlob {
 	blobID := randBytes(32)
 
 	uploads := make([]StorageUpload, 0)
+	ended := 0 // if this panics, every upload from here on gets aborted, so nothing is left half written
+	defer func() {
+		for _, upload := range uploads[ended:] {
+			upload.Abort()
+		}
+	}()
 	for _, storage := range storageDests {
 		uploads = append(uploads, storage.BeginBlobUpload(blobID))
 	}
@@ -116,70 +316,106 @@ func execute(plan BlobPlan, tx *sql.Tx, storageDests []Storage) {
 	out = io.MultiWriter(out, &preEncInfo)
 
 	entries := make([]BlobEntry, 0)
+	repacked := make([]BlobEntry, 0)
+	hashedNow := make([]hashedDuringUpload, 0)
+	chunkedFiles := make([]chunkedFile, 0)
+	seenChunks := make(map[[32]byte]bool)
 
 outer:
 	for _, toUp := range plan {
 		log.Println("Adding", toUp)
-		startOffset := preEncInfo.size
 		for _, option := range toUp.options {
 			path := option.path
-			stat, err := os.Stat(path)
-			if err != nil {
-				log.Println("Option", path, "is no longer available:", err)
-				continue
-			}
-			if stat.ModTime().Unix() != option.fs_modified {
-				log.Println("Option", path, "is no longer usable due to fs last modified having changed: ", stat.ModTime().Unix(), "while expected", option.fs_modified)
-				continue
-			}
-			if stat.Size() != toUp.size {
-				log.Println("Option", path, "is no longer usable due to size having changed: ", stat.Size(), "while expected", toUp.size)
-				continue
-			}
-			// going to use this option
-			f, err := os.Open(path)
-			if err != nil {
-				log.Println("File exists but I can no longer read from it to back it up???", err)
-				continue
+			var f io.ReadCloser
+			if option.fromStorage {
+				path = hex.EncodeToString(toUp.hash)
+				log.Println("Reading", path, "back out of storage")
+				// this is only for repacking, which never chunks, so writeChunks won't try to take the read lock again while this has it
+				f = btx.cat(toUp.hash)
+				if f == nil {
+					continue
+				}
+			} else {
+				var stat os.FileInfo
+				var err error
+				f, stat, err = openSource(path)
+				if err != nil {
+					log.Println("Option", path, "is no longer available:", err)
+					continue
+				}
+				if stat.ModTime().Unix() != option.fs_modified {
+					log.Println("Option", path, "is no longer usable due to fs last modified having changed: ", stat.ModTime().Unix(), "while expected", option.fs_modified)
+					f.Close()
+					continue
+				}
+				if stat.Size() != toUp.size {
+					log.Println("Option", path, "is no longer usable due to size having changed: ", stat.Size(), "while expected", toUp.size)
+					f.Close()
+					continue
+				}
+				// going to use this option
 			}
 			verify := NewSHA256HasherSizer()
+			src := &stopOnError{r: f}
+			var fileEntries []BlobEntry
+			var chunks []fileChunk
 			// make function so we can defer
 			func() {
 				defer f.Close() // this is why we make a function here
-				tmpOut := out   // TODO compressor(out)
-				if _, err := io.Copy(io.MultiWriter(tmpOut, &verify), f); err != nil {
-					// not recoverable since we have written an unknown amount of truncated bytes =(
-					panic(err)
+				in := io.TeeReader(src, &verify)
+				if toUp.size >= config.Config().ChunkingMinSize && !toUp.repack { // a repacked entry has to stay exactly the entry it was
+					fileEntries, chunks = writeChunks(path, in, out, &preEncInfo, seenChunks, btx)
+				} else {
+					fileEntries = []BlobEntry{writeEntry(path, in, out, &preEncInfo)}
 				}
 			}()
 			realHash, realSize := verify.HashAndSize()
-			if realSize != toUp.size {
-				// not recoverable since we have written incorrect data =(
+			bad := false
+			if src.err != nil {
+				log.Println("Reading", path, "failed partway:", src.err)
+				bad = true
+			} else if realSize != toUp.size {
 				log.Println("File copied successfully, but bytes read was", realSize, "when we expected", toUp.size)
-				break // panics
-			}
-			if !bytes.Equal(realHash, toUp.hash) {
-				// not recoverable since we have written incorrect data =(
+				bad = true
+			} else if toUp.hash != nil && !bytes.Equal(realHash, toUp.hash) {
 				log.Println("File copied successfully, but hash was", hex.EncodeToString(realHash), "when we expected", hex.EncodeToString(toUp.hash))
-				break // panics
+				bad = true
+			}
+			if bad {
+				// what got written is still in the blob, but nothing will point to it, so it's just dead space
+				// the rest of the blob is fine, so carry on with the next option
+				log.Println("Dropping what was written from", path)
+				for _, entry := range fileEntries {
+					if entry.hash != nil { // only chunks have their hash yet
+						delete(seenChunks, sliceToArr(entry.hash))
+					}
+				}
+				continue
+			}
+			if toUp.hash == nil {
+				log.Println("Hashed during upload:", path, "is", hex.EncodeToString(realHash))
+				hashedNow = append(hashedNow, hashedDuringUpload{option, realHash, realSize})
+			}
+			if chunks != nil {
+				chunkedFiles = append(chunkedFiles, chunkedFile{realHash, chunks})
+			} else {
+				fileEntries[0].hash = realHash
+			}
+			if toUp.repack {
+				repacked = append(repacked, fileEntries...)
+			} else {
+				entries = append(entries, fileEntries...)
 			}
-			end := preEncInfo.size
-			length := end - startOffset
-			log.Println("File length was", realSize, "but was compressed to", length)
-			entries = append(entries, BlobEntry{
-				hash:        toUp.hash,
-				offset:      startOffset,
-				length:      length,
-				compression: nil,
-			})
 			continue outer
 		}
-		panic("None of the options worked. Don't change files while I'm reading them please :sob: :sob:")
+		// it'll still need uploading next time, so it'll be picked up again then
+		log.Println("WARNING: None of the options for", toUp, "worked, so skipping it this time. Don't change files while I'm reading them please :sob: :sob:")
 	}
-	out.Write(make([]byte, 5021)) // padding
+	out.Write(make([]byte, blobPadding))
 	log.Println("All bytes writen")
 	completeds := make([]CompletedUpload, 0)
 	for _, upload := range uploads {
+		ended++ // an End that fails partway has already cleaned up what it could, aborting it as well would wait forever on s3
 		completeds = append(completeds, upload.End())
 	}
 	hashPreEnc, sizePreEnc := preEncInfo.HashAndSize()
@@ -187,28 +423,128 @@ outer:
 	if sizePreEnc != sizePostEnc {
 		panic("what??")
 	}
-	totalSize := sizePreEnc
+	return builtBlob{
+		blobID:       blobID,
+		key:          key,
+		size:         sizePreEnc,
+		hashPreEnc:   hashPreEnc,
+		hashPostEnc:  hashPostEnc,
+		entries:      entries,
+		repacked:     repacked,
+		hashedNow:    hashedNow,
+		chunkedFiles: chunkedFiles,
+		completeds:   completeds,
+	}
+}
 
-	_, err := tx.Exec("INSERT INTO blobs (blob_id, encryption_key, size, hash_pre_enc, hash_post_enc) VALUES (?, ?, ?, ?, ?)", blobID, key, totalSize, hashPreEnc, hashPostEnc)
+// everything about a blob that's been uploaded goes into the database
+func saveBlob(blob builtBlob, tx *sql.Tx, storageDests []Storage) {
+	_, err := tx.Exec("INSERT INTO blobs (blob_id, encryption_key, size, hash_pre_enc, hash_post_enc) VALUES (?, ?, ?, ?, ?)", blob.blobID, blob.key, blob.size, blob.hashPreEnc, blob.hashPostEnc)
 	if err != nil {
 		panic(err)
 	}
 
-	for _, entry := range entries {
-		_, err = tx.Exec("INSERT INTO blob_entries (hash, blob_id, final_size, offset, compression_alg) VALUES (?, ?, ?, ?, ?)", entry.hash, blobID, entry.length, entry.offset, entry.compression)
+	for _, hashed := range blob.hashedNow {
+		_, err = tx.Exec("INSERT OR IGNORE INTO hashes (hash, size) VALUES (?, ?)", hashed.hash, hashed.size)
 		if err != nil {
 			panic(err)
 		}
 	}
+
+	for _, file := range blob.chunkedFiles {
+		saveChunkHashes(file, tx)
+	}
+
+	for _, entry := range blob.entries {
+		if entryExists(entry.hash, tx) {
+			// only possible for something hashed during upload, where it turned out that an identical file was already uploaded (e.g. earlier in this same run)
+			// or for a chunk that another blob being uploaded at the same time also had
+			// this entry is just dead space in the blob now
+			log.Println("Already have a blob entry for", hex.EncodeToString(entry.hash), "so not adding another")
+			continue
+		}
+		_, err = tx.Exec("INSERT INTO blob_entries (hash, blob_id, final_size, offset, compression_alg) VALUES (?, ?, ?, ?, ?)", entry.hash, blob.blobID, entry.length, entry.offset, entry.compression)
+		if err != nil {
+			panic(err)
+		}
+	}
+	for _, entry := range blob.repacked {
+		log.Println("Moving the blob entry for", hex.EncodeToString(entry.hash), "into this blob")
+		_, err = tx.Exec("UPDATE blob_entries SET blob_id = ?, final_size = ?, offset = ?, compression_alg = ? WHERE hash = ?", blob.blobID, entry.length, entry.offset, entry.compression, entry.hash)
+		if err != nil {
+			panic(err)
+		}
+	}
+	for _, file := range blob.chunkedFiles {
+		saveChunkList(file, tx)
+	}
+
+	for _, hashed := range blob.hashedNow {
+		var expectedHash []byte
+		err = tx.QueryRow("SELECT hash FROM files WHERE path = ? AND end IS NULL", hashed.source.path).Scan(&expectedHash)
+		if err != nil && err != ErrNoRows {
+			panic(err)
+		}
+		saveFileHash(hashed.source.path, hashed.hash, hashed.size, hashed.source.fs_modified, *hashed.source.metadata, expectedHash, tx)
+	}
+
 	now := time.Now().Unix()
-	for i, completed := range completeds {
-		_, err := tx.Exec("INSERT INTO blob_storage (blob_id, storage_id, full_path, checksum, timestamp) VALUES (?, ?, ?, ?, ?)", blobID, storageDests[i].GetID(), completed.path, completed.checksum, now)
+	for i, completed := range blob.completeds {
+		_, err := tx.Exec("INSERT INTO blob_storage (blob_id, storage_id, full_path, checksum, timestamp) VALUES (?, ?, ?, ?, ?)", blob.blobID, storageDests[i].GetID(), completed.path, completed.checksum, now)
 		if err != nil {
 			panic(err)
 		}
 	}
 }
 
+// reads until the underlying reader fails, then acts like that was the end, remembering why
+// so that a file that can't be read all the way through just becomes a short entry that gets dropped, instead of breaking the whole blob
+type stopOnError struct {
+	r   io.Reader
+	err error
+}
+
+func (s *stopOnError) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// compress (if it's worth it) and write one entry into the blob
+// the hash is left for the caller to fill in, since it might not be known until this is done reading
+func writeEntry(path string, in io.Reader, out io.Writer, position *HasherSizer) BlobEntry {
+	startOffset := position.size
+	alg, in := chooseCompression(path, in)
+	var compression *string
+	var compressor io.WriteCloser
+	if alg != nil {
+		name := alg.AlgName()
+		compression = &name
+		compressor = alg.Compress(out)
+		out = compressor
+	}
+	n, err := io.Copy(out, in)
+	if err != nil {
+		// reading can't fail here (see stopOnError), so this is writing to the upload failing, and that's not recoverable =(
+		panic(err)
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil { // flushes the rest out
+			panic(err)
+		}
+	}
+	length := position.size - startOffset
+	log.Println("Entry length was", n, "but was compressed to", length)
+	return BlobEntry{
+		offset:      startOffset,
+		length:      length,
+		compression: compression,
+	}
+}
+
 func calcToUpload(tx *sql.Tx) []ToUpload {
 	rows, err := tx.Query(`
 		SELECT
@@ -228,6 +564,7 @@ func calcToUpload(tx *sql.Tx) []ToUpload {
 							) uniq_hash    /* distinct hashes of all our that currently exist */
 						LEFT OUTER JOIN blob_entries ON uniq_hash.hash = blob_entries.hash
 						WHERE blob_entries.hash IS NULL /* but filter out hashes that have already been backed up (i.e. have an entry in blob_entries */
+							AND NOT EXISTS (SELECT 1 FROM file_chunks WHERE file_chunks.hash = uniq_hash.hash) /* or were split into chunks that have been */
 					
 					) to_upload /* hashes that we're going to upload */
 				INNER JOIN hashes ON to_upload.hash = hashes.hash
@@ -254,9 +591,9 @@ func calcToUpload(tx *sql.Tx) []ToUpload {
 		hash := sliceToArr(hashSlice)
 		toUp, ok := plan[hash]
 		if !ok {
-			toUp = ToUpload{hashSlice, size, nil}
+			toUp = ToUpload{hashSlice, size, nil, false}
 		}
-		toUp.options = append(toUp.options, UploadSource{path, fs_modified})
+		toUp.options = append(toUp.options, UploadSource{path, fs_modified, false, nil})
 		plan[hash] = toUp
 	}
 	err = rows.Err()
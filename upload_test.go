@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/leijurv/gb/config"
+)
+
+func withMinBlobSize(size int64, fn func()) {
+	old := config.Config()
+	defer config.SetConfig(old)
+	c := old
+	c.MinBlobSize = size
+	config.SetConfig(c)
+	fn()
+}
+
+func TestHashDuringUpload(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		withMinBlobSize(100, func() {
+			err := ioutil.WriteFile(filepath.Join(src, "big"), make([]byte, 5021), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hashLater := backupADirectoryRecursively(src)
+			if len(hashLater) != 1 {
+				t.Fatalf("a big file of a new size should be hashed later, got %d", len(hashLater))
+			}
+			if n := countRows(t, "SELECT COUNT(*) FROM files"); n != 0 {
+				t.Fatalf("it shouldn't be in files until it's hashed, but there are %d rows", n)
+			}
+			upload(hashLater)
+			if n := countRows(t, "SELECT COUNT(*) FROM files INNER JOIN hashes ON hashes.hash = files.hash WHERE hashes.size = 5021"); n != 1 {
+				t.Fatalf("expected it in files and hashes after uploading, got %d", n)
+			}
+			if n := countRows(t, "SELECT COUNT(*) FROM blob_entries"); n != 1 {
+				t.Fatalf("expected one blob entry, got %d", n)
+			}
+			testAll()
+		})
+	})
+}
+
+func TestHashDuringScanWithNowhereToUpload(t *testing.T) {
+	WithTestingDatabase(t, func() {
+		withMinBlobSize(100, func() {
+			src, err := ioutil.TempDir("", "gb-src-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(src)
+			err = ioutil.WriteFile(filepath.Join(src, "big"), make([]byte, 5021), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hashLater := backupADirectoryRecursively(src)
+			if len(hashLater) != 0 {
+				t.Fatalf("there's nowhere to upload to, so nothing should be hashed later, got %d", len(hashLater))
+			}
+			upload(hashLater)
+			if n := countRows(t, "SELECT COUNT(*) FROM files"); n != 1 {
+				t.Fatalf("expected it in files anyway, got %d", n)
+			}
+		})
+	})
+}
+
+func TestChangedFileIsDroppedFromBlob(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		a := filepath.Join(src, "a")
+		err := ioutil.WriteFile(a, []byte("aaaa"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(src, "b"), []byte("bbbb"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backupADirectoryRecursively(src)
+		// same size and last modified, so it still looks usable, but it isn't what was hashed anymore
+		err = ioutil.WriteFile(a, []byte("cccc"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(a, info.ModTime(), info.ModTime())
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload(nil)
+		if n := countRows(t, "SELECT COUNT(*) FROM blob_entries INNER JOIN files ON files.hash = blob_entries.hash WHERE files.path = ?", a); n != 0 {
+			t.Errorf("a's entry should have been dropped")
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM blob_entries"); n != 1 {
+			t.Errorf("b should still have been uploaded, got %d entries", n)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM blob_storage"); n != 1 {
+			t.Errorf("the blob should still have been uploaded, got %d", n)
+		}
+		var hash []byte
+		err = db.QueryRow("SELECT hash FROM files WHERE path = ?", filepath.Join(src, "b")).Scan(&hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		data, err := ioutil.ReadAll(cat(hash, tx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "bbbb" {
+			t.Errorf("expected bbbb, got %q", data)
+		}
+	})
+}
+
+func TestConcurrentUploads(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		withMinBlobSize(100, func() {
+			for i := 0; i < 20; i++ {
+				err := ioutil.WriteFile(filepath.Join(src, fmt.Sprint(i)), randBytes(100+i%5), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			old := config.Config()
+			defer config.SetConfig(old)
+			c := old
+			c.UploadConcurrency = 8
+			config.SetConfig(c)
+			upload(backupADirectoryRecursively(src))
+			if n := countRows(t, "SELECT COUNT(*) FROM blobs"); n != 20 {
+				t.Errorf("every file is big enough for its own blob, expected 20 but got %d", n)
+			}
+			if n := countRows(t, "SELECT COUNT(*) FROM blob_storage"); n != 20 {
+				t.Errorf("expected 20 blobs on the storage, got %d", n)
+			}
+			if n := countRows(t, "SELECT COUNT(*) FROM files INNER JOIN blob_entries ON blob_entries.hash = files.hash"); n != 20 {
+				t.Errorf("expected every file to have been uploaded, got %d", n)
+			}
+			testAll()
+		})
+	})
+}
+
+func TestUploadConcurrency(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		addStorage("slow disk", "Disk", src, "gb/", nil)
+		old := config.Config()
+		defer config.SetConfig(old)
+		c := old
+		c.UploadConcurrency = 6
+		for _, limit := range []struct {
+			perStorage map[string]int
+			expected   int
+		}{
+			{map[string]int{}, 6},
+			{map[string]int{"Disk": 2}, 2},
+			{map[string]int{"slow disk": 3}, 3},
+			{map[string]int{"slow disk": 3, "Disk": 2}, 2}, // the label wins for that one, but the other one is still a Disk
+			{map[string]int{"other": 1}, 6},
+		} {
+			c.UploadConcurrencyPerStorage = limit.perStorage
+			config.SetConfig(c)
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := uploadConcurrency(GetAll(tx), tx); n != limit.expected {
+				t.Errorf("with %v, expected %d but got %d", limit.perStorage, limit.expected, n)
+			}
+			tx.Commit()
+		}
+	})
+}
+
+// a storage that stops working after a few blobs, like the network going down partway through
+type failingStorage struct {
+	Storage
+	remaining int32
+}
+
+func (s *failingStorage) BeginBlobUpload(blobID []byte) StorageUpload {
+	if atomic.AddInt32(&s.remaining, -1) < 0 {
+		panic("the network is down")
+	}
+	return s.Storage.BeginBlobUpload(blobID)
+}
+
+func TestInterruptedUploadKeepsProgress(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		withMinBlobSize(100, func() {
+			for i := 0; i < 5; i++ {
+				err := ioutil.WriteFile(filepath.Join(src, fmt.Sprint(i)), randBytes(200), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			blobPlans, storages := planUpload(backupADirectoryRecursively(src))
+			if len(blobPlans) != 5 {
+				t.Fatalf("expected a blob per file, got %d", len(blobPlans))
+			}
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("the failure should still be reported")
+					}
+				}()
+				executeAll(blobPlans, []Storage{&failingStorage{storages[0], 2}})
+			}()
+			if n := countRows(t, "SELECT COUNT(*) FROM blob_storage"); n != 2 {
+				t.Fatalf("the two blobs that made it should have been committed, got %d", n)
+			}
+			if n := countRows(t, "SELECT COUNT(*) FROM files"); n != 2 {
+				t.Fatalf("the files in them should have been committed too, got %d", n)
+			}
+
+			nextBackup()
+			upload(backupADirectoryRecursively(src))
+			if n := countRows(t, "SELECT COUNT(*) FROM blobs"); n != 5 {
+				t.Errorf("only the other three should have been uploaded the second time, but there are %d blobs", n)
+			}
+			if n := countRows(t, "SELECT COUNT(*) FROM files INNER JOIN blob_entries ON blob_entries.hash = files.hash"); n != 5 {
+				t.Errorf("expected every file to be uploaded by now, got %d", n)
+			}
+			testAll()
+		})
+	})
+}
+
+func TestFailedBlobAbortsItsUploads(t *testing.T) {
+	WithDiskStorage(t, func(src string, dest string) {
+		err := ioutil.WriteFile(filepath.Join(src, "a"), []byte("aaa"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobPlans, storages := planUpload(backupADirectoryRecursively(src))
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("the failure should still be reported")
+				}
+			}()
+			// the first upload has begun by the time the second storage fails
+			executeAll(blobPlans, []Storage{storages[0], &failingStorage{storages[0], 0}})
+		}()
+		err = filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				t.Errorf("the upload should have been aborted, but %s is still there", path)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"syscall"
+)
+
+// a problem reading xattrs doesn't stop the file from being backed up, it just gets logged
+func readXattrs(path string) map[string][]byte {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil {
+		if err != syscall.ENOTSUP {
+			log.Println("Unable to list xattrs of", path, err)
+		}
+		return nil
+	}
+	if size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		log.Println("Unable to list xattrs of", path, err)
+		return nil
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := getXattr(path, string(name))
+		if err != nil {
+			log.Println("Unable to read xattr", string(name), "of", path, err)
+			continue
+		}
+		xattrs[string(name)] = value
+	}
+	return xattrs
+}
+
+func getXattr(path string, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+func writeXattr(path string, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
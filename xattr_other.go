@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// only linux xattrs are supported for now
+func readXattrs(path string) map[string][]byte {
+	return nil
+}
+
+func writeXattr(path string, name string, value []byte) error {
+	return errors.New("xattrs aren't supported on this OS")
+}